@@ -1,41 +1,194 @@
 package config
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
-	"gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
 )
 
 type KibanaConfigs struct {
-	Kibanas []KibanaConfig `yaml:"kibanas"`
+	// settings of all the targets, unless set by the target or its template
+	Defaults *KibanaConfig `yaml:"defaults,omitempty"`
+	// named sets of settings, used by the targets with the template field
+	Templates map[string]*KibanaConfig `yaml:"templates,omitempty"`
+	Kibanas   []KibanaConfig           `yaml:"kibanas"`
+	// settings (auth, TLS, timeout...) shared by the targets scraped by URL,
+	// like ?target=https://host:5601&module=prod
+	Modules map[string]*KibanaConfig `yaml:"modules,omitempty"`
+	// regular expression the URL of a target must fully match to be scraped by
+	// URL; no target can be scraped by URL if not set
+	TargetAllowlist string `yaml:"target_allowlist,omitempty"`
+
+	allowlist *regexp.Regexp
+	// content of the file, to find the line of the errors
+	node *yaml.Node
 
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]interface{} `yaml:",inline" json:"-"`
 }
 
 type KibanaConfig struct {
-	Name     string `yaml:"name"`
+	Name string `yaml:"name"`
+	// name of the template the settings not set are taken from
+	Template string `yaml:"template,omitempty"`
 	Protocol string `yaml:"protocol,omitempty"`
 	Host     string `yaml:"host,omitempty"`
 	Port     string `yaml:"port,omitempty"`
+	// path Kibana is served under (server.basePath or reverse proxy), like /kibana
+	BasePath string `yaml:"base_path,omitempty"`
 	Username string `yaml:"username,omitempty"`
 	Password string `yaml:"password,omitempty"`
-	Skip     string `yaml:"skip-tls,omitempty"`
-	Wait     string `yaml:"wait,omitempty"`
+	// Elasticsearch API key, the base64 encoded "id:api_key" value
+	ApiKey      string `yaml:"api_key,omitempty"`
+	BearerToken string `yaml:"bearer_token,omitempty"`
+	// files holding the credentials, read on each scrape
+	PasswordFile    string `yaml:"password_file,omitempty"`
+	ApiKeyFile      string `yaml:"api_key_file,omitempty"`
+	BearerTokenFile string `yaml:"bearer_token_file,omitempty"`
+	Skip            string `yaml:"skip-tls,omitempty"`
+	Wait            string `yaml:"wait,omitempty"`
+	V8Format        string `yaml:"v8format,omitempty"`
+	Timeout         string `yaml:"timeout,omitempty"`
+	// CA, client certificate and TLS settings for https URLs
+	TLSConfig *TLSConfig `yaml:"tls_config,omitempty"`
+	// headers added to each request, for proxies needing a tenant or routing header
+	Headers map[string]string `yaml:"headers,omitempty"`
+	// static labels added to all the metrics of the target (env, datacenter, team...)
+	Labels map[string]string `yaml:"labels,omitempty"`
+	// optional collectors run on each scrape besides api/status, like task_manager or alerting
+	Collectors []string `yaml:"collectors,omitempty"`
+	// outbound proxy (http, https or socks5 URL), HTTP_PROXY, HTTPS_PROXY and
+	// NO_PROXY environment variables are used if not set
+	ProxyURL string `yaml:"proxy_url,omitempty"`
+	// comma separated hosts, domains (.corp.local), IPs or CIDRs reached without proxy
+	NoProxy string `yaml:"no_proxy,omitempty"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+
+	uri      string
+	skip     bool
+	wait     bool
+	v8format bool
+	timeout  time.Duration
+	proxyURL *url.URL
+	noProxy  []string
+}
+
+// TLSConfig is the TLS configuration used to connect to a Kibana served over https.
+type TLSConfig struct {
+	// CA bundle used to verify the certificate of Kibana, system's CAs if not set
+	CAFile string `yaml:"ca_file,omitempty"`
+	// client certificate and key for mutual TLS
+	CertFile string `yaml:"cert_file,omitempty"`
+	KeyFile  string `yaml:"key_file,omitempty"`
+	// name used to verify the certificate of Kibana, host of the URL if not set
+	ServerName string `yaml:"server_name,omitempty"`
+	// TLS10, TLS11, TLS12 or TLS13
+	MinVersion string `yaml:"min_version,omitempty"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
 
-	uri  string
-	skip bool
-	wait bool
+var tlsVersions = map[string]uint16{
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
 }
 
+// Optional collectors of a target.
+const (
+	// health of the Task Manager from api/task_manager/_health
+	CollectorTaskManager = "task_manager"
+	// alerting framework health and rules from api/alerting/_health and
+	// api/alerting/rules/_find
+	CollectorAlerting = "alerting"
+	// instance and cluster identifiers and usage from api/stats?extended=true
+	CollectorStats = "stats"
+)
+
+// OptionalCollectors are the names of the optional collectors a target may set.
+var OptionalCollectors = []string{CollectorTaskManager, CollectorAlerting, CollectorStats}
+
+// Labels of the metrics exported for every target, used by the exporter to
+// build them.
+var (
+	InfosLabels         = []string{"version", "build"}
+	OsInfoLabels        = []string{"platform", "platform_release"}
+	ServiceStatusLabels = []string{"service", "kind", "level"}
+	StatusLevelLabels   = []string{"level"}
+	ScrapeErrorsLabels  = []string{"reason"}
+	CollectorLabels     = []string{"collector"}
+	// label of the quantiles of the summaries, set by Prometheus
+	SummaryLabels = []string{"quantile"}
+)
+
+// Labels of the metrics of the optional collectors, used by the exporter to
+// build them.
+var (
+	TaskManagerStatusLabels      = []string{"status"}
+	TaskManagerStatsStatusLabels = []string{"stat", "status"}
+	TaskManagerWorkloadLabels    = []string{"task_type", "status"}
+	TaskManagerPeriodLabels      = []string{"period"}
+	TaskManagerPercentileLabels  = []string{"percentile"}
+
+	AlertingHealthLabels  = []string{"check", "status"}
+	AlertingRulesLabels   = []string{"rule_type", "enabled", "status"}
+	AlertingLastRunLabels = []string{"rule_type", "outcome"}
+	AlertingErrorLabels   = []string{"rule_type", "reason"}
+
+	StatsInfoLabels         = []string{"uuid", "name", "host", "transport_address", "cluster_uuid"}
+	StatsSavedObjectsLabels = []string{"type"}
+)
+
+// MetricLabels are the labels of the metrics always exported for a target;
+// its static labels can't have the same names.
+var MetricLabels = joinLabels(InfosLabels, OsInfoLabels, ServiceStatusLabels,
+	StatusLevelLabels, ScrapeErrorsLabels, CollectorLabels, SummaryLabels)
+
+// CollectorMetricLabels are the labels of the metrics of each optional
+// collector, reserved for the targets running it only.
+var CollectorMetricLabels = map[string][]string{
+	CollectorTaskManager: joinLabels(TaskManagerStatusLabels, TaskManagerStatsStatusLabels,
+		TaskManagerWorkloadLabels, TaskManagerPeriodLabels, TaskManagerPercentileLabels),
+	CollectorAlerting: joinLabels(AlertingHealthLabels, AlertingRulesLabels,
+		AlertingLastRunLabels, AlertingErrorLabels),
+	CollectorStats: joinLabels(StatsInfoLabels, StatsSavedObjectsLabels),
+}
+
+// joinLabels returns the labels of all the lists.
+func joinLabels(lists ...[]string) []string {
+	labels := make([]string, 0)
+	for _, list := range lists {
+		labels = append(labels, list...)
+	}
+	return labels
+}
+
+// DefaultTimeout is the ceiling of the duration of a scrape when the target
+// has no timeout set; it matches the default scrape_timeout of Prometheus.
+const DefaultTimeout = 10 * time.Second
+
 // *************************************************************
 //
 // *************************************************************
 // Load attempts to parse the given config file and return a Config object.
+// All the errors found in the file are returned at once in a *ConfigError.
 func Load(configFile string) (*KibanaConfigs, error) {
 	//	log.Infof("Loading profiles from %s", profilesFile)
 	buf, err := ioutil.ReadFile(configFile)
@@ -43,41 +196,185 @@ func Load(configFile string) (*KibanaConfigs, error) {
 		return nil, err
 	}
 
-	kibanas := KibanaConfigs{}
-	err = yaml.Unmarshal(buf, &kibanas)
-	if err != nil {
-		return nil, err
-	}
-	err = kibanas.check()
+	// the nodes give the line numbers of the errors
+	root := &yaml.Node{}
+	err = yaml.Unmarshal(buf, root)
 	if err != nil {
 		return nil, err
 	}
+	errs := &ConfigError{}
+	expandEnv(root, errs)
 
-	err = checkOverflow(kibanas.XXX, "kibanas")
-	if err != nil {
+	kibanas := KibanaConfigs{}
+	if len(root.Content) > 0 {
+		kibanas.node = root.Content[0]
+		err = kibanas.node.Decode(&kibanas)
+		if terr, ok := err.(*yaml.TypeError); ok {
+			// the values of the right type are decoded anyway
+			for _, msg := range terr.Errors {
+				errs.addDecode(msg)
+			}
+		} else if err != nil {
+			errs.add(0, err)
+			return nil, errs.err()
+		}
+	}
+	kibanas.checkAll(errs)
+	if err := errs.err(); err != nil {
 		return nil, err
 	}
 
 	return &kibanas, nil
 }
 
+// valid Prometheus label names
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// ${VAR} references to environment variables
+var envVarRE = regexp.MustCompile(`\$\{([a-zA-Z_][a-zA-Z0-9_]*)\}`)
+
+// expandEnv replaces the ${VAR} references in the values of the config by
+// the value of the environment variable; undefined variables are errors.
+// A lone $ (for example in a password) is kept as is; keys and comments are
+// not expanded.
+func expandEnv(node *yaml.Node, errs *ConfigError) {
+	if node.Kind == yaml.ScalarNode {
+		node.Value = envVarRE.ReplaceAllStringFunc(node.Value, func(ref string) string {
+			name := envVarRE.FindStringSubmatch(ref)[1]
+			val, ok := os.LookupEnv(name)
+			if !ok {
+				errs.add(node.Line, fmt.Errorf("undefined environment variable %s", name))
+				return ref
+			}
+			return val
+		})
+		return
+	}
+	for index, child := range node.Content {
+		if node.Kind == yaml.MappingNode && index%2 == 0 {
+			continue
+		}
+		expandEnv(child, errs)
+	}
+}
+
 // *************************************************************
 //
 // KibanaConfigs: list of KibanaConfig
 //
 // *************************************************************
-// check the sanity of the sockets in the set
+// check the sanity of the sockets in the set; every error is reported with
+// its line in the file when loaded from a file.
 func (c *KibanaConfigs) check() error {
-	if len(c.Kibanas) == 0 {
-		return fmt.Errorf("no valid config found")
+	errs := &ConfigError{}
+	c.checkAll(errs)
+	return errs.err()
+}
+
+// checkAll adds all the errors of the set to errs.
+func (c *KibanaConfigs) checkAll(errs *ConfigError) {
+	for key := range c.XXX {
+		errs.add(keyLine(c.node, key), fmt.Errorf("unknown field %s", key))
 	}
+	if len(c.Kibanas) == 0 && len(c.Modules) == 0 {
+		errs.add(0, fmt.Errorf("no valid config found"))
+	}
+	if c.Defaults != nil {
+		node := valueNode(c.node, "defaults")
+		c.Defaults.checkBase("defaults", node, errs)
+	}
+	for name, template := range c.Templates {
+		if template != nil {
+			node := valueNode(valueNode(c.node, "templates"), name)
+			template.checkBase("template "+name, node, errs)
+		}
+	}
+
+	names := make(map[string]int)
+	targets := valueNode(c.node, "kibanas")
 	for index := range c.Kibanas {
-		err := c.Kibanas[index].check()
+		kibana := &c.Kibanas[index]
+		var node *yaml.Node
+		if targets != nil && index < len(targets.Content) {
+			node = targets.Content[index]
+		}
+		if kibana.Name != "" {
+			if line, ok := names[kibana.Name]; ok {
+				errs.add(keyLine(node, "name"), fmt.Errorf("duplicate target name %s, first defined line %d", kibana.Name, line))
+			} else {
+				names[kibana.Name] = keyLine(node, "name")
+			}
+		}
+		for key := range kibana.XXX {
+			errs.add(keyLine(node, key), fmt.Errorf("unknown field %s for %s", key, kibana.Name))
+		}
+		// explicit values win over the template, then the defaults
+		if kibana.Template != "" {
+			template, ok := c.Templates[kibana.Template]
+			if !ok {
+				errs.add(keyLine(node, "template"), fmt.Errorf("unknown template %s for %s", kibana.Template, kibana.Name))
+			}
+			kibana.inherit(template)
+		}
+		kibana.inherit(c.Defaults)
+		// the invalid values of the template and the defaults are reported
+		// in their own block
+		errs.addTarget(node, ownErrors(node, kibana.check()))
+	}
+
+	modules := valueNode(c.node, "modules")
+	for name, module := range c.Modules {
+		if module == nil {
+			module = &KibanaConfig{}
+			c.Modules[name] = module
+		}
+		errs.addTarget(valueNode(modules, name), module.checkModule(name))
+	}
+	if c.TargetAllowlist != "" {
+		var err error
+		// the whole URL must match
+		c.allowlist, err = regexp.Compile("^(?:" + c.TargetAllowlist + ")$")
 		if err != nil {
-			return (err)
+			errs.add(keyLine(c.node, "target_allowlist"), fmt.Errorf("invalid target_allowlist: %s", err))
 		}
 	}
-	return (nil)
+}
+
+// TargetConfig returns the config of a target scraped by URL, built from the
+// settings of the module; an empty module name selects the "default" module
+// if any. The URL must match target_allowlist.
+func (c *KibanaConfigs) TargetConfig(target string, module string) (*KibanaConfig, error) {
+	if c.allowlist == nil {
+		return nil, fmt.Errorf("targets can't be scraped by URL: target_allowlist not set")
+	}
+	if !c.allowlist.MatchString(target) {
+		return nil, fmt.Errorf("target %s not allowed by target_allowlist", target)
+	}
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid target URL %s: must be http(s)://host[:port][/base_path]", target)
+	}
+	if u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("invalid target URL %s: credentials, query and fragment are not allowed", target)
+	}
+
+	if module == "" {
+		module = "default"
+	}
+	kibana := &KibanaConfig{}
+	if mod, ok := c.Modules[module]; ok {
+		// settings of the module are only read
+		*kibana = *mod
+	} else if module != "default" {
+		return nil, fmt.Errorf("unknown module %s", module)
+	}
+	kibana.Name = target
+	if err := kibana.SetDefault(target, kibana.skip, kibana.wait); err != nil {
+		return nil, err
+	}
+	// the same target is always named the same
+	kibana.Name = kibana.Url()
+	return kibana, nil
 }
 
 // *************************************************************
@@ -113,13 +410,17 @@ func parseBool(val string) (bool, error) {
 // *************************************************************
 // Check the sanity of the socket and fills the default values
 func (c *KibanaConfig) check() error {
+	var errs fieldErrors
 
 	if c.Name == "" {
-		return (fmt.Errorf("config must have the field name set"))
+		errs.add("", fmt.Errorf("config must have the field name set"))
 	}
 
+	c.Protocol = strings.ToLower(c.Protocol)
 	if c.Protocol == "" {
 		c.Protocol = "http"
+	} else if c.Protocol != "http" && c.Protocol != "https" {
+		errs.add("protocol", fmt.Errorf("invalid protocol %s for %s: must be http or https", c.Protocol, c.Name))
 	}
 
 	if c.Host == "" {
@@ -128,15 +429,19 @@ func (c *KibanaConfig) check() error {
 
 	if c.Port == "" {
 		c.Port = "5601"
+	} else if port, err := strconv.Atoi(c.Port); err != nil || port < 1 || port > 65535 {
+		errs.add("port", fmt.Errorf("invalid port %s for %s: must be a number between 1 and 65535", c.Port, c.Name))
 	}
 
+	c.BasePath = cleanBasePath(c.BasePath)
+
 	if c.Skip == "" {
 		c.skip = false
 	} else {
 		var err error
 		c.skip, err = parseBool(c.Skip)
 		if err != nil {
-			return err
+			errs.add("skip-tls", fmt.Errorf("invalid skip-tls for %s: %s", c.Name, err))
 		}
 	}
 
@@ -146,36 +451,362 @@ func (c *KibanaConfig) check() error {
 		var err error
 		c.wait, err = parseBool(c.Wait)
 		if err != nil {
-			return err
+			errs.add("wait", fmt.Errorf("invalid wait for %s: %s", c.Name, err))
 		}
 	}
 
+	errs = append(errs, c.parseOptions()...)
+
 	c.uri = c.url()
 
-	return (nil)
+	return errs.err()
+}
+
+// hasAuth tells if any auth setting is set.
+func (c *KibanaConfig) hasAuth() bool {
+	return c.Username != "" || c.Password != "" || c.PasswordFile != "" ||
+		c.ApiKey != "" || c.ApiKeyFile != "" ||
+		c.BearerToken != "" || c.BearerTokenFile != ""
+}
+
+// inherit sets the settings not set in c from base; headers and labels are
+// merged with the ones of c winning. The auth settings are inherited all together
+// when c has none, so that a target may use another auth method; a target
+// with only its own password inherits the username. A partial
+// username/password left after the merge is reported by parseOptions.
+func (c *KibanaConfig) inherit(base *KibanaConfig) {
+	if base == nil {
+		return
+	}
+	setDefault := func(val *string, def string) {
+		if *val == "" {
+			*val = def
+		}
+	}
+	setDefault(&c.Protocol, base.Protocol)
+	setDefault(&c.Host, base.Host)
+	setDefault(&c.Port, base.Port)
+	setDefault(&c.BasePath, base.BasePath)
+	if !c.hasAuth() {
+		c.Username = base.Username
+		c.Password = base.Password
+		c.PasswordFile = base.PasswordFile
+		c.ApiKey = base.ApiKey
+		c.ApiKeyFile = base.ApiKeyFile
+		c.BearerToken = base.BearerToken
+		c.BearerTokenFile = base.BearerTokenFile
+	} else if c.Username == "" && (c.Password != "" || c.PasswordFile != "") {
+		// the same user with a password per target
+		c.Username = base.Username
+	}
+	setDefault(&c.Skip, base.Skip)
+	setDefault(&c.Wait, base.Wait)
+	setDefault(&c.V8Format, base.V8Format)
+	setDefault(&c.Timeout, base.Timeout)
+	setDefault(&c.ProxyURL, base.ProxyURL)
+	setDefault(&c.NoProxy, base.NoProxy)
+	if c.TLSConfig == nil {
+		c.TLSConfig = base.TLSConfig
+	}
+	c.Headers = mergeMap(base.Headers, c.Headers)
+	c.Labels = mergeMap(base.Labels, c.Labels)
+	// an empty list disables the collectors of base
+	if c.Collectors == nil {
+		c.Collectors = base.Collectors
+	}
+}
+
+// mergeMap returns the entries of base and the ones of m, m winning.
+func mergeMap(base map[string]string, m map[string]string) map[string]string {
+	if len(base) == 0 {
+		return m
+	}
+	merged := make(map[string]string, len(base)+len(m))
+	for name, val := range base {
+		merged[name] = val
+	}
+	for name, val := range m {
+		merged[name] = val
+	}
+	return merged
+}
+
+// checkBase checks the defaults and the templates: they are not targets, but
+// their values are checked like the ones of a target.
+func (c *KibanaConfig) checkBase(where string, node *yaml.Node, errs *ConfigError) {
+	if c.Name != "" {
+		errs.add(keyLine(node, "name"), fmt.Errorf("name can't be set in %s", where))
+	}
+	if c.Template != "" {
+		errs.add(keyLine(node, "template"), fmt.Errorf("template can't be set in %s", where))
+	}
+	for key := range c.XXX {
+		errs.add(keyLine(node, key), fmt.Errorf("unknown field %s in %s", key, where))
+	}
+	// a copy, the values are converted again for each target
+	base := *c
+	base.Name = where
+	errs.addTarget(node, baseErrors(base.check()))
+}
+
+// baseErrors drops the errors about a partial username/password of the
+// defaults or a template: the targets may complete it, their merged settings
+// are checked.
+func baseErrors(err error) error {
+	ferrs, ok := err.(fieldErrors)
+	if !ok {
+		return err
+	}
+	var kept fieldErrors
+	for _, ferr := range ferrs {
+		if ferr.related != authField {
+			kept = append(kept, ferr)
+		}
+	}
+	return kept.err()
+}
+
+// checkModule checks the settings of a module: everything but the location
+// of Kibana, given by the URL of each target.
+func (c *KibanaConfig) checkModule(name string) error {
+	var errs fieldErrors
+
+	for _, field := range []struct{ name, value string }{
+		{"name", c.Name},
+		{"template", c.Template},
+		{"protocol", c.Protocol},
+		{"host", c.Host},
+		{"port", c.Port},
+		{"base_path", c.BasePath},
+	} {
+		if field.value != "" {
+			errs.add(field.name, fmt.Errorf("%s can't be set in module %s", field.name, name))
+		}
+	}
+	for key := range c.XXX {
+		errs.add(key, fmt.Errorf("unknown field %s in module %s", key, name))
+	}
+	c.Name = "module " + name
+
+	if c.Skip != "" {
+		var err error
+		c.skip, err = parseBool(c.Skip)
+		if err != nil {
+			errs.add("skip-tls", fmt.Errorf("invalid skip-tls for %s: %s", c.Name, err))
+		}
+	}
+	if c.Wait != "" {
+		var err error
+		c.wait, err = parseBool(c.Wait)
+		if err != nil {
+			errs.add("wait", fmt.Errorf("invalid wait for %s: %s", c.Name, err))
+		}
+	}
+	errs = append(errs, c.parseOptions()...)
+
+	return errs.err()
+}
+
+// parseOptions checks and converts the optional settings shared by the
+// targets of the config file and the one built from the command line.
+func (c *KibanaConfig) parseOptions() fieldErrors {
+	var errs fieldErrors
+
+	// only one auth method per target
+	methods := make([]string, 0)
+	if c.Username != "" || c.Password != "" || c.PasswordFile != "" {
+		methods = append(methods, "username/password")
+	}
+	if c.ApiKey != "" || c.ApiKeyFile != "" {
+		methods = append(methods, "api_key")
+	}
+	if c.BearerToken != "" || c.BearerTokenFile != "" {
+		methods = append(methods, "bearer_token")
+	}
+	if len(methods) > 1 {
+		errs.add(authField, fmt.Errorf("only one auth method can be set for %s, found: %s", c.Name, strings.Join(methods, ", ")))
+	} else if c.Username != "" && c.Password == "" && c.PasswordFile == "" {
+		// a partial basic auth would silently be unauthenticated
+		errs.addRelated("username", authField, fmt.Errorf("username without password or password_file for %s", c.Name))
+	} else if c.Username == "" && (c.Password != "" || c.PasswordFile != "") {
+		field := "password"
+		if c.PasswordFile != "" {
+			field = "password_file"
+		}
+		errs.addRelated(field, authField, fmt.Errorf("%s without username for %s", field, c.Name))
+	}
+
+	// a secret and its file are exclusive; the file must be readable now to
+	// fail early, it is read again on each scrape to follow rotations.
+	for _, secret := range []struct{ name, value, file string }{
+		{"password", c.Password, c.PasswordFile},
+		{"api_key", c.ApiKey, c.ApiKeyFile},
+		{"bearer_token", c.BearerToken, c.BearerTokenFile},
+	} {
+		if secret.file == "" {
+			continue
+		}
+		if secret.value != "" {
+			errs.add(secret.name+"_file", fmt.Errorf("%s and %s_file are exclusive for %s", secret.name, secret.name, c.Name))
+			continue
+		}
+		if _, err := ReadSecretFile(secret.file); err != nil {
+			errs.add(secret.name+"_file", fmt.Errorf("invalid %s_file for %s: %s", secret.name, c.Name, err))
+		}
+	}
+
+	if c.V8Format == "" {
+		c.v8format = false
+	} else {
+		var err error
+		c.v8format, err = parseBool(c.V8Format)
+		if err != nil {
+			errs.add("v8format", fmt.Errorf("invalid v8format for %s: %s", c.Name, err))
+		}
+	}
+
+	for name := range c.Headers {
+		if http.CanonicalHeaderKey(name) == "Authorization" {
+			errs.add("headers."+name, fmt.Errorf("invalid header for %s: Authorization is set by the auth settings", c.Name))
+		}
+	}
+
+	for name := range c.Labels {
+		if !labelNameRE.MatchString(name) || strings.HasPrefix(name, "__") {
+			errs.add("labels."+name, fmt.Errorf("invalid label name %s for %s", name, c.Name))
+		} else if containsString(MetricLabels, name) {
+			errs.add("labels."+name, fmt.Errorf("invalid label name %s for %s: label of a metric", name, c.Name))
+		} else {
+			for _, collector := range c.Collectors {
+				if containsString(CollectorMetricLabels[collector], name) {
+					errs.addRelated("labels."+name, "collectors", fmt.Errorf("invalid label name %s for %s: label of a metric of the %s collector", name, c.Name, collector))
+					break
+				}
+			}
+		}
+	}
+
+	seen := make(map[string]bool, len(c.Collectors))
+	for _, name := range c.Collectors {
+		if !isOptionalCollector(name) {
+			errs.add("collectors", fmt.Errorf("unknown collector %s for %s, must be one of: %s", name, c.Name, strings.Join(OptionalCollectors, ", ")))
+		} else if seen[name] {
+			errs.add("collectors", fmt.Errorf("duplicate collector %s for %s", name, c.Name))
+		}
+		seen[name] = true
+	}
+
+	c.proxyURL = nil
+	if c.ProxyURL != "" {
+		proxyURL, err := url.Parse(c.ProxyURL)
+		if err != nil {
+			errs.add("proxy_url", fmt.Errorf("invalid proxy_url for %s: %s", c.Name, err))
+		} else {
+			switch proxyURL.Scheme {
+			case "http", "https", "socks5", "socks5h":
+				c.proxyURL = proxyURL
+			default:
+				errs.add("proxy_url", fmt.Errorf("invalid proxy_url for %s: scheme must be http, https or socks5", c.Name))
+			}
+		}
+	}
+	c.noProxy = make([]string, 0)
+	for _, entry := range strings.Split(c.NoProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry != "" {
+			c.noProxy = append(c.noProxy, entry)
+		}
+	}
+
+	if c.TLSConfig != nil {
+		keys := make([]string, 0, len(c.TLSConfig.XXX))
+		for key := range c.TLSConfig.XXX {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			errs.add("tls_config."+key, fmt.Errorf("unknown field %s in tls_config for %s", key, c.Name))
+		}
+		if len(keys) == 0 {
+			// build it once to check files and settings
+			if _, err := c.TLSConfig.build(false); err != nil {
+				errs.add("tls_config", fmt.Errorf("invalid tls_config for %s: %s", c.Name, err))
+			}
+		}
+	}
+
+	if c.Timeout == "" {
+		c.timeout = DefaultTimeout
+	} else {
+		var err error
+		c.timeout, err = time.ParseDuration(c.Timeout)
+		if err != nil {
+			errs.add("timeout", fmt.Errorf("invalid timeout for %s: %s", c.Name, err))
+		} else if c.timeout < 0 {
+			errs.add("timeout", fmt.Errorf("invalid timeout for %s: must not be negative", c.Name))
+		}
+	}
+
+	return errs
+}
+
+// isOptionalCollector tells if name is the name of an optional collector.
+func isOptionalCollector(name string) bool {
+	return containsString(OptionalCollectors, name)
+}
+
+// containsString tells if list contains s.
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
 }
 
 func (c *KibanaConfig) url() string {
 	var s strings.Builder
 
 	s.WriteString(fmt.Sprintf("%s://%s:%s", c.Protocol, c.Host, c.Port))
+	s.WriteString(c.BasePath)
 
 	return s.String()
 
 }
-func (c *KibanaConfig) SetDefault(url string, skipTls bool, wait bool) error {
-	urlLineRE := regexp.MustCompile(`^(https?)://([^:]+)(?::(\d+))`)
-	match := urlLineRE.FindStringSubmatch(url)
-	if match != nil {
-		c.Protocol = match[1]
-		c.Host = match[2]
-		c.Port = match[3]
+
+// cleanBasePath returns the base path with a leading slash and without a
+// trailing one; empty when Kibana is served at the root.
+func cleanBasePath(path string) string {
+	path = strings.Trim(strings.TrimSpace(path), "/")
+	if path == "" {
+		return ""
+	}
+	return "/" + path
+}
+
+// SetDefault sets the location of Kibana from its URL, the path being kept
+// as the base path, and checks the options.
+func (c *KibanaConfig) SetDefault(uri string, skipTls bool, wait bool) error {
+	u, err := url.Parse(strings.TrimSpace(uri))
+	// the scheme is lowercased by url.Parse
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid URL %s for %s: must be http(s)://host[:port][/base_path]", uri, c.Name)
 	}
-	c.uri = url
+	c.Protocol = u.Scheme
+	c.Host = u.Hostname()
+	c.Port = u.Port()
+	c.BasePath = cleanBasePath(u.Path)
+	host := u.Host
+	if (u.Scheme == "http" && c.Port == "80") || (u.Scheme == "https" && c.Port == "443") {
+		// the default port is implicit
+		host = strings.TrimSuffix(host, ":"+c.Port)
+	}
+	c.uri = u.Scheme + "://" + host + c.BasePath
 	c.skip = skipTls
 	c.wait = wait
 
-	return nil
+	return c.parseOptions().err()
 }
 
 func (c *KibanaConfig) Url() string {
@@ -190,6 +821,319 @@ func (c *KibanaConfig) WaitKibana() bool {
 	return c.wait
 }
 
+// V8StatusFormat tells if the 8.x status format must be requested from the instance
+// (?v8format=true), useful for 7.x instances only.
+func (c *KibanaConfig) V8StatusFormat() bool {
+	return c.v8format
+}
+
+// ScrapeTimeout is the ceiling of the duration of a scrape of the target;
+// 0 means no limit.
+func (c *KibanaConfig) ScrapeTimeout() time.Duration {
+	return c.timeout
+}
+
+// Proxy returns the function selecting the proxy of the requests to Kibana:
+// none for hosts in no_proxy, proxy_url if set, the one of the environment
+// variables otherwise.
+func (c *KibanaConfig) Proxy() func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		if matchNoProxy(c.noProxy, req.URL.Hostname()) {
+			return nil, nil
+		}
+		if c.proxyURL != nil {
+			return c.proxyURL, nil
+		}
+		return http.ProxyFromEnvironment(req)
+	}
+}
+
+// matchNoProxy tells if host must be reached without proxy: it is listed,
+// is a sub-domain of a listed domain, or is an IP of a listed CIDR.
+func matchNoProxy(noProxy []string, host string) bool {
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	for _, entry := range noProxy {
+		if entry == "*" {
+			return true
+		}
+		if _, cidr, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		domain := strings.TrimPrefix(strings.TrimPrefix(entry, "*"), ".")
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// TLSClientConfig returns the TLS configuration to use to connect to Kibana,
+// built from tls_config and skip-tls.
+func (c *KibanaConfig) TLSClientConfig() (*tls.Config, error) {
+	if c.TLSConfig == nil {
+		return &tls.Config{InsecureSkipVerify: c.skip}, nil
+	}
+	return c.TLSConfig.build(c.skip)
+}
+
+// build converts the TLS configuration into a tls.Config, loading the CA
+// bundle and the client certificate.
+func (t *TLSConfig) build(skip bool) (*tls.Config, error) {
+	tConf := &tls.Config{
+		InsecureSkipVerify: skip,
+		ServerName:         t.ServerName,
+	}
+
+	if t.CAFile != "" {
+		ca, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA file: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no valid PEM certificate found in CA file %s", t.CAFile)
+		}
+		tConf.RootCAs = pool
+	}
+
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return nil, fmt.Errorf("cert_file and key_file must be set together")
+	}
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %s", err)
+		}
+		tConf.Certificates = []tls.Certificate{cert}
+	}
+
+	if t.MinVersion != "" {
+		version, ok := tlsVersions[strings.ToUpper(t.MinVersion)]
+		if !ok {
+			return nil, fmt.Errorf("unknown min_version %q, must be TLS10, TLS11, TLS12 or TLS13", t.MinVersion)
+		}
+		tConf.MinVersion = version
+	}
+
+	return tConf, nil
+}
+
+// ReadSecretFile returns the content of a file holding a credential, without
+// the surrounding spaces and newlines.
+func ReadSecretFile(file string) (string, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// *************************************************************
+//
+// errors of the config
+//
+// *************************************************************
+
+// ConfigError holds all the errors found in the config.
+type ConfigError struct {
+	// messages sorted by line, prefixed with the line in the file when known
+	Errors []string
+
+	errs []lineError
+}
+
+type lineError struct {
+	line int
+	err  error
+}
+
+func (e *ConfigError) Error() string {
+	return strings.Join(e.Errors, "; ")
+}
+
+// add adds an error found at line, 0 if unknown.
+func (e *ConfigError) add(line int, err error) {
+	e.errs = append(e.errs, lineError{line: line, err: err})
+}
+
+// addTarget adds the errors of a target (or module) at the line of their
+// field, at the line of the target otherwise.
+func (e *ConfigError) addTarget(node *yaml.Node, err error) {
+	if err == nil {
+		return
+	}
+	ferrs, ok := err.(fieldErrors)
+	if !ok {
+		e.add(keyLine(node, ""), err)
+		return
+	}
+	for _, ferr := range ferrs {
+		line := keyLine(node, ferr.field)
+		if key := fieldKey(node, ferr.field); key != nil {
+			line = key.Line
+		} else if key := fieldKey(node, ferr.related); key != nil && ferr.related != "" {
+			line = key.Line
+		} else if index := strings.Index(ferr.field, "."); index > 0 {
+			line = keyLine(node, ferr.field[:index])
+		}
+		e.add(line, ferr.err)
+	}
+}
+
+// yaml.v3 prefixes the messages of its type errors with their line
+var decodeErrorRE = regexp.MustCompile(`^line ([0-9]+): (.*)$`)
+
+// addDecode adds an error of the decoding of the file at its line.
+func (e *ConfigError) addDecode(msg string) {
+	if match := decodeErrorRE.FindStringSubmatch(msg); match != nil {
+		line, _ := strconv.Atoi(match[1])
+		e.add(line, errors.New(match[2]))
+		return
+	}
+	e.add(0, errors.New(msg))
+}
+
+// err returns the ConfigError if any error was found, nil otherwise.
+func (e *ConfigError) err() error {
+	if len(e.errs) == 0 {
+		return nil
+	}
+	sort.SliceStable(e.errs, func(i, j int) bool { return e.errs[i].line < e.errs[j].line })
+	e.Errors = make([]string, 0, len(e.errs))
+	for _, lerr := range e.errs {
+		if lerr.line > 0 {
+			e.Errors = append(e.Errors, fmt.Sprintf("line %d: %s", lerr.line, lerr.err))
+		} else {
+			e.Errors = append(e.Errors, lerr.err.Error())
+		}
+	}
+	return e
+}
+
+// fieldError is an error in the value of a field of a target; field is
+// empty when the error is not about a single field.
+type fieldError struct {
+	field string
+	err   error
+	// other field the error comes from the combination with, if any
+	related string
+}
+
+// fieldErrors are all the errors found in the fields of a target.
+type fieldErrors []fieldError
+
+// authField is the field of the errors about the auth settings as a whole.
+const authField = "auth"
+
+// ownErrors returns the errors of a target about the fields set in its node,
+// dropping the ones about the fields inherited from its template or the
+// defaults; err is returned as is without node.
+func ownErrors(node *yaml.Node, err error) error {
+	ferrs, ok := err.(fieldErrors)
+	if !ok || node == nil {
+		return err
+	}
+	var own fieldErrors
+	for _, ferr := range ferrs {
+		switch {
+		case ferr.field == "":
+		case ferr.related == authField:
+			// a partial username/password may come from the merge, the
+			// defaults and the templates don't report it
+		case ferr.field == authField:
+			// the auth settings are inherited all together
+			set := false
+			for _, key := range []string{"username", "password", "password_file", "api_key", "api_key_file", "bearer_token", "bearer_token_file"} {
+				set = set || fieldKey(node, key) != nil
+			}
+			if !set {
+				continue
+			}
+		default:
+			if fieldKey(node, ferr.field) == nil && (ferr.related == "" || fieldKey(node, ferr.related) == nil) {
+				continue
+			}
+		}
+		own = append(own, ferr)
+	}
+	return own.err()
+}
+
+func (e fieldErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, ferr := range e {
+		msgs = append(msgs, ferr.err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e *fieldErrors) add(field string, err error) {
+	*e = append(*e, fieldError{field: field, err: err})
+}
+
+// addRelated adds an error coming from the values of field and related.
+func (e *fieldErrors) addRelated(field string, related string, err error) {
+	*e = append(*e, fieldError{field: field, err: err, related: related})
+}
+
+// err returns the errors if any, nil otherwise.
+func (e fieldErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// valueNode returns the value of key in the mapping node, nil if not found.
+func valueNode(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// fieldKey returns the key of field in the mapping node of a target, nil if
+// not set; an entry of a map field is named like labels.env.
+func fieldKey(node *yaml.Node, field string) *yaml.Node {
+	if index := strings.Index(field, "."); index > 0 {
+		node, field = valueNode(node, field[:index]), field[index+1:]
+	}
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == field {
+			return node.Content[i]
+		}
+	}
+	return nil
+}
+
+// keyLine returns the line of key in the mapping node, the line of the node
+// if not found or key is empty; 0 without node.
+func keyLine(node *yaml.Node, key string) int {
+	if node == nil {
+		return 0
+	}
+	if key != "" && node.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == key {
+				return node.Content[i].Line
+			}
+		}
+	}
+	return node.Line
+}
+
 // to catch unwanted params in config file
 func checkOverflow(m map[string]interface{}, ctx string) error {
 	if len(m) > 0 {
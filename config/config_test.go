@@ -0,0 +1,695 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// auth methods conflicts tests
+var authConflictTests = []struct {
+	desc   string
+	kibana KibanaConfig
+	valid  bool
+}{
+	{
+		desc:   "no auth",
+		kibana: KibanaConfig{Name: "kibana"},
+		valid:  true,
+	},
+	{
+		desc:   "username and password",
+		kibana: KibanaConfig{Name: "kibana", Username: "kibanau", Password: "kibanap"},
+		valid:  true,
+	},
+	{
+		desc:   "api key",
+		kibana: KibanaConfig{Name: "kibana", ApiKey: "a2V5"},
+		valid:  true,
+	},
+	{
+		desc:   "bearer token",
+		kibana: KibanaConfig{Name: "kibana", BearerToken: "dG9rZW4="},
+		valid:  true,
+	},
+	{
+		desc:   "username and api key",
+		kibana: KibanaConfig{Name: "kibana", Username: "kibanau", ApiKey: "a2V5"},
+		valid:  false,
+	},
+	{
+		desc:   "username without password",
+		kibana: KibanaConfig{Name: "kibana", Username: "kibanau"},
+		valid:  false,
+	},
+	{
+		desc:   "password without username",
+		kibana: KibanaConfig{Name: "kibana", Password: "kibanap"},
+		valid:  false,
+	},
+	{
+		desc:   "api key and bearer token",
+		kibana: KibanaConfig{Name: "kibana", ApiKey: "a2V5", BearerToken: "dG9rZW4="},
+		valid:  false,
+	},
+}
+
+func TestAuthConflicts(t *testing.T) {
+	for _, at := range authConflictTests {
+		t.Run(at.desc, func(t *testing.T) {
+			err := at.kibana.check()
+			if at.valid && err != nil {
+				t.Errorf("expected valid config, got: %s", err)
+			}
+			if !at.valid && err == nil {
+				t.Errorf("expected an error for conflicting auth methods")
+			}
+		})
+	}
+}
+
+func TestLoadExpandEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kibana-exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configFile := filepath.Join(dir, "kibana.yml")
+	content := `
+kibanas:
+  - name: kibana
+    host: ${KIBANA_TEST_HOST}
+    username: kibana_exporter
+    password: ${KIBANA_TEST_PASSWORD}$1
+    # comments are not expanded: ${KIBANA_TEST_UNDEFINED}
+`
+	if err := ioutil.WriteFile(configFile, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("KIBANA_TEST_HOST", "kibana.local")
+	os.Setenv("KIBANA_TEST_PASSWORD", "s3cr3t")
+	defer os.Unsetenv("KIBANA_TEST_HOST")
+	defer os.Unsetenv("KIBANA_TEST_PASSWORD")
+
+	kibanas, err := Load(configFile)
+	if err != nil {
+		t.Fatalf("Load failed with valid input: %s", err)
+	}
+	kibana := kibanas.Kibanas[0]
+	if kibana.Host != "kibana.local" {
+		t.Errorf("expected host kibana.local, got %s", kibana.Host)
+	}
+	// a lone $ is not a reference
+	if kibana.Password != "s3cr3t$1" {
+		t.Errorf("expected password s3cr3t$1, got %s", kibana.Password)
+	}
+
+	os.Unsetenv("KIBANA_TEST_PASSWORD")
+	if _, err := Load(configFile); err == nil {
+		t.Errorf("expected error for an undefined environment variable")
+	}
+}
+
+func TestSecretFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kibana-exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	passwordFile := filepath.Join(dir, "password")
+	if err := ioutil.WriteFile(passwordFile, []byte("kibanap\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	kibana := KibanaConfig{Name: "kibana", Username: "kibanau", PasswordFile: passwordFile}
+	if err := kibana.check(); err != nil {
+		t.Errorf("expected valid config, got: %s", err)
+	}
+	kibana = KibanaConfig{Name: "kibana", Username: "kibanau", Password: "kibanap", PasswordFile: passwordFile}
+	if err := kibana.check(); err == nil {
+		t.Errorf("expected an error when both password and password_file are set")
+	}
+	kibana = KibanaConfig{Name: "kibana", ApiKeyFile: filepath.Join(dir, "missing")}
+	if err := kibana.check(); err == nil {
+		t.Errorf("expected an error for a missing api_key_file")
+	}
+}
+
+// tls_config tests
+var tlsConfigTests = []struct {
+	desc      string
+	tlsConfig TLSConfig
+	valid     bool
+}{
+	{
+		desc:      "server name and min version",
+		tlsConfig: TLSConfig{ServerName: "kibana.local", MinVersion: "TLS12"},
+		valid:     true,
+	},
+	{
+		desc:      "unknown min version",
+		tlsConfig: TLSConfig{MinVersion: "SSL3"},
+		valid:     false,
+	},
+	{
+		desc:      "cert without key",
+		tlsConfig: TLSConfig{CertFile: "client.crt"},
+		valid:     false,
+	},
+	{
+		desc:      "missing CA file",
+		tlsConfig: TLSConfig{CAFile: "/nonexistent/ca.crt"},
+		valid:     false,
+	},
+}
+
+func TestTLSConfig(t *testing.T) {
+	for _, tt := range tlsConfigTests {
+		t.Run(tt.desc, func(t *testing.T) {
+			tlsConfig := tt.tlsConfig
+			kibana := KibanaConfig{Name: "kibana", Protocol: "https", TLSConfig: &tlsConfig}
+			err := kibana.check()
+			if tt.valid && err != nil {
+				t.Errorf("expected valid config, got: %s", err)
+			}
+			if !tt.valid && err == nil {
+				t.Errorf("expected an error for invalid tls_config")
+			}
+		})
+	}
+}
+
+// url tests
+var urlTests = []struct {
+	desc, uri, protocol, host, port, basePath, url string
+}{
+	{
+		desc:     "root",
+		uri:      "http://localhost:5601",
+		protocol: "http",
+		host:     "localhost",
+		port:     "5601",
+		url:      "http://localhost:5601",
+	},
+	{
+		desc:     "base path without port",
+		uri:      "https://lb.corp/kibana/",
+		protocol: "https",
+		host:     "lb.corp",
+		basePath: "/kibana",
+		url:      "https://lb.corp/kibana",
+	},
+	{
+		desc:     "base path with port",
+		uri:      "https://lb.corp:8443/tenants/kibana",
+		protocol: "https",
+		host:     "lb.corp",
+		port:     "8443",
+		basePath: "/tenants/kibana",
+		url:      "https://lb.corp:8443/tenants/kibana",
+	},
+}
+
+func TestSetDefaultURL(t *testing.T) {
+	for _, ut := range urlTests {
+		t.Run(ut.desc, func(t *testing.T) {
+			kibana := KibanaConfig{Name: "default"}
+			if err := kibana.SetDefault(ut.uri, false, false); err != nil {
+				t.Fatalf("SetDefault failed with valid input: %s", err)
+			}
+			if kibana.Protocol != ut.protocol || kibana.Host != ut.host || kibana.Port != ut.port || kibana.BasePath != ut.basePath {
+				t.Errorf("expected %s, %s, %s, %s, got %s, %s, %s, %s", ut.protocol, ut.host, ut.port, ut.basePath,
+					kibana.Protocol, kibana.Host, kibana.Port, kibana.BasePath)
+			}
+			if kibana.Url() != ut.url {
+				t.Errorf("expected url %s, got %s", ut.url, kibana.Url())
+			}
+		})
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	kibana := KibanaConfig{Name: "kibana", Host: "lb.corp", Protocol: "https", Port: "443", BasePath: "kibana/"}
+	if err := kibana.check(); err != nil {
+		t.Fatalf("expected valid config, got: %s", err)
+	}
+	if kibana.Url() != "https://lb.corp:443/kibana" {
+		t.Errorf("expected url https://lb.corp:443/kibana, got %s", kibana.Url())
+	}
+}
+
+func TestMatchNoProxy(t *testing.T) {
+	noProxy := []string{"localhost", ".corp.local", "kibana.example.com", "10.0.0.0/8"}
+	for host, expected := range map[string]bool{
+		"localhost":              true,
+		"kibana.corp.local":      true,
+		"corp.local":             true,
+		"kibana.example.com":     true,
+		"eu.kibana.example.com":  true,
+		"10.1.2.3":               true,
+		"192.168.1.1":            false,
+		"kibana.other.com":       false,
+		"notkibana.example.com":  false,
+		"kibana.corp.local.evil": false,
+	} {
+		if got := matchNoProxy(noProxy, host); got != expected {
+			t.Errorf("%s: expected %t, got %t", host, expected, got)
+		}
+	}
+	if !matchNoProxy([]string{"*"}, "anything") {
+		t.Errorf("* should match every host")
+	}
+}
+
+func TestProxyURL(t *testing.T) {
+	for proxy, valid := range map[string]bool{
+		"http://proxy.corp:3128":    true,
+		"socks5://proxy.corp:1080":  true,
+		"ftp://proxy.corp":          false,
+		"http://proxy corp:3128/%%": false,
+	} {
+		kibana := KibanaConfig{Name: "kibana", ProxyURL: proxy}
+		err := kibana.check()
+		if valid && err != nil {
+			t.Errorf("%s: expected valid config, got: %s", proxy, err)
+		}
+		if !valid && err == nil {
+			t.Errorf("%s: expected an error for invalid proxy_url", proxy)
+		}
+	}
+}
+
+func TestTargetConfig(t *testing.T) {
+	kibanas := KibanaConfigs{
+		Modules: map[string]*KibanaConfig{
+			"prod":    {ApiKey: "a2V5", Timeout: "5s"},
+			"default": {Username: "kibanau", Password: "kibanap"},
+		},
+		TargetAllowlist: `https://kibana-[0-9]+\.corp(:[0-9]+)?(/.*)?`,
+	}
+	if err := kibanas.check(); err != nil {
+		t.Fatalf("expected valid config, got: %s", err)
+	}
+
+	kibana, err := kibanas.TargetConfig("https://kibana-1.corp:5601/kibana/", "prod")
+	if err != nil {
+		t.Fatalf("TargetConfig failed with valid input: %s", err)
+	}
+	if kibana.Url() != "https://kibana-1.corp:5601/kibana" || kibana.BasePath != "/kibana" {
+		t.Errorf("expected url https://kibana-1.corp:5601/kibana, got %s", kibana.Url())
+	}
+	if kibana.ApiKey != "a2V5" || kibana.ScrapeTimeout() != 5*time.Second {
+		t.Errorf("expected the settings of module prod, got %+v", kibana)
+	}
+	// the module is not modified
+	if kibanas.Modules["prod"].Url() != "" {
+		t.Errorf("module modified by TargetConfig")
+	}
+
+	kibana, err = kibanas.TargetConfig("https://kibana-2.corp", "")
+	if err != nil {
+		t.Fatalf("TargetConfig failed with valid input: %s", err)
+	}
+	if kibana.Username != "kibanau" {
+		t.Errorf("expected the settings of module default, got %+v", kibana)
+	}
+
+	for target, module := range map[string]string{
+		"https://kibana-1.corp.evil.com": "prod",
+		"http://kibana-1.corp":           "prod",
+		"https://kibana-1.corp":          "unknown",
+		"https://kibana-1.corp/?x=y":     "prod",
+	} {
+		if _, err := kibanas.TargetConfig(target, module); err == nil {
+			t.Errorf("%s (module %s): expected an error", target, module)
+		}
+	}
+
+	// no allowlist: no target by URL
+	kibanas = KibanaConfigs{Kibanas: []KibanaConfig{{Name: "kibana"}}}
+	if err := kibanas.check(); err != nil {
+		t.Fatalf("expected valid config, got: %s", err)
+	}
+	if _, err := kibanas.TargetConfig("http://localhost:5601", ""); err == nil {
+		t.Errorf("expected an error without target_allowlist")
+	}
+}
+
+func TestSetDefault(t *testing.T) {
+	for _, test := range []struct {
+		uri, protocol, host, port, basePath, url string
+	}{
+		{"http://localhost:5601/", "http", "localhost", "5601", "", "http://localhost:5601"},
+		{"https://kibana.corp/kibana/", "https", "kibana.corp", "", "/kibana", "https://kibana.corp/kibana"},
+		{"HTTPS://kibana.corp:5601", "https", "kibana.corp", "5601", "", "https://kibana.corp:5601"},
+		{"https://[fd00::1]:5601", "https", "fd00::1", "5601", "", "https://[fd00::1]:5601"},
+		{"https://kibana.corp:443/", "https", "kibana.corp", "443", "", "https://kibana.corp"},
+	} {
+		kibana := KibanaConfig{Name: "kibana"}
+		if err := kibana.SetDefault(test.uri, false, false); err != nil {
+			t.Errorf("%s: SetDefault failed with valid input: %s", test.uri, err)
+			continue
+		}
+		if kibana.Protocol != test.protocol || kibana.Host != test.host || kibana.Port != test.port ||
+			kibana.BasePath != test.basePath || kibana.Url() != test.url {
+			t.Errorf("%s: unexpected location %s %s %s %s %s", test.uri, kibana.Protocol, kibana.Host, kibana.Port, kibana.BasePath, kibana.Url())
+		}
+	}
+
+	for _, uri := range []string{"localhost:5601", "ftp://kibana.corp", "https://"} {
+		kibana := KibanaConfig{Name: "kibana"}
+		if err := kibana.SetDefault(uri, false, false); err == nil {
+			t.Errorf("%s: expected an error for an invalid URL", uri)
+		}
+	}
+}
+
+func TestModuleLocation(t *testing.T) {
+	kibanas := KibanaConfigs{
+		Modules: map[string]*KibanaConfig{"prod": {Host: "kibana.corp"}},
+	}
+	if err := kibanas.check(); err == nil {
+		t.Errorf("expected an error for a module with a host")
+	}
+}
+
+func TestDefaultsAndTemplates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kibana-exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configFile := filepath.Join(dir, "kibana.yml")
+	content := `
+defaults:
+  protocol: https
+  port: 443
+  skip-tls: yes
+  username: kibana_exporter
+  password: s3cr3t
+  headers:
+    X-Tenant: ops
+  labels:
+    env: prod
+  collectors: [task_manager]
+templates:
+  cloud:
+    port: 9243
+    api_key: a2V5
+kibanas:
+  - name: kibana-1
+    host: kibana-1.corp
+  - name: kibana-2
+    host: kibana-2.corp
+    skip-tls: no
+    headers:
+      X-Tenant: dev
+    labels:
+      team: search
+    collectors: []
+  - name: kibana-cloud
+    host: kibana.cloud.es.io
+    template: cloud
+`
+	if err := ioutil.WriteFile(configFile, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	kibanas, err := Load(configFile)
+	if err != nil {
+		t.Fatalf("Load failed with valid input: %s", err)
+	}
+
+	kibana := kibanas.Kibanas[0]
+	if kibana.Url() != "https://kibana-1.corp:443" || !kibana.SkipTls() || kibana.Username != "kibana_exporter" || kibana.Headers["X-Tenant"] != "ops" || len(kibana.Collectors) != 1 {
+		t.Errorf("expected the defaults for kibana-1, got %+v", kibana)
+	}
+	// explicit values win
+	kibana = kibanas.Kibanas[1]
+	if kibana.SkipTls() || kibana.Headers["X-Tenant"] != "dev" || kibana.Labels["env"] != "prod" || kibana.Labels["team"] != "search" || len(kibana.Collectors) != 0 {
+		t.Errorf("expected the values of kibana-2, got %+v", kibana)
+	}
+	// the template wins over the defaults, its auth method replaces the one of the defaults
+	kibana = kibanas.Kibanas[2]
+	if kibana.Url() != "https://kibana.cloud.es.io:9243" || kibana.ApiKey != "a2V5" || kibana.Username != "" {
+		t.Errorf("expected the template for kibana-cloud, got %+v", kibana)
+	}
+
+	content = `
+kibanas:
+  - name: kibana
+    template: unknown
+`
+	if err := ioutil.WriteFile(configFile, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(configFile); err == nil {
+		t.Errorf("expected an error for an unknown template")
+	}
+
+	// the password of the defaults is not inherited by a target with its own username
+	content = `
+defaults:
+  username: kibana_exporter
+  password: s3cr3t
+kibanas:
+  - name: kibana
+    username: other
+`
+	if err := ioutil.WriteFile(configFile, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = Load(configFile)
+	if err == nil || err.Error() != "line 7: username without password or password_file for kibana" {
+		t.Errorf("expected an error for a username without password, got: %v", err)
+	}
+
+	// the username of the defaults with a password per target
+	content = `
+defaults:
+  username: monitor
+kibanas:
+  - name: kibana-1
+    password: s3cr3t-1
+  - name: kibana-2
+    password: s3cr3t-2
+`
+	if err := ioutil.WriteFile(configFile, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	kibanas, err = Load(configFile)
+	if err != nil {
+		t.Fatalf("Load failed with valid input: %s", err)
+	}
+	if kibana := kibanas.Kibanas[1]; kibana.Username != "monitor" || kibana.Password != "s3cr3t-2" {
+		t.Errorf("expected the username of the defaults for kibana-2, got %+v", kibana)
+	}
+
+	// the merged target is checked
+	content = `
+defaults:
+  username: monitor
+kibanas:
+  - name: kibana-1
+    password: s3cr3t-1
+  - name: kibana-2
+`
+	if err := ioutil.WriteFile(configFile, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = Load(configFile)
+	if err == nil || err.Error() != "line 7: username without password or password_file for kibana-2" {
+		t.Errorf("expected an error for the username of the defaults without password, got: %v", err)
+	}
+}
+
+func TestValidationErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kibana-exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configFile := filepath.Join(dir, "kibana.yml")
+	content := `kibanas:
+  - name: kibana-1
+    protocol: ftp
+    port: http
+  - name: kibana-2
+    username: kibana_exporter
+    api_key: a2V5
+    pasword: s3cr3t
+  - name: kibana-1
+    timeout: -5s
+unknown: true
+`
+	if err := ioutil.WriteFile(configFile, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = Load(configFile)
+	cerr, ok := err.(*ConfigError)
+	if !ok {
+		t.Fatalf("expected a *ConfigError, got: %v", err)
+	}
+	expected := []string{
+		"line 3: invalid protocol ftp for kibana-1: must be http or https",
+		"line 4: invalid port http for kibana-1: must be a number between 1 and 65535",
+		"line 5: only one auth method can be set for kibana-2, found: username/password, api_key",
+		"line 8: unknown field pasword for kibana-2",
+		"line 9: duplicate target name kibana-1, first defined line 2",
+		"line 10: invalid timeout for kibana-1: must not be negative",
+		"line 11: unknown field unknown",
+	}
+	if strings.Join(cerr.Errors, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected errors:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(cerr.Errors, "\n"))
+	}
+
+	// all the errors at once, the ones of the defaults and the templates in
+	// their own block
+	os.Unsetenv("KIBANA_EXPORTER_UNDEFINED")
+	for _, test := range []struct {
+		content  string
+		expected []string
+	}{
+		{
+			content: `kibana:
+  - name: kibana-1
+`,
+			expected: []string{
+				"no valid config found",
+				"line 1: unknown field kibana",
+			},
+		},
+		{
+			content: `defaults:
+  port: http
+  labels:
+    team-name: search
+templates:
+  cloud:
+    timeout: 5
+kibanas:
+  - name: kibana-1
+    password: ${KIBANA_EXPORTER_UNDEFINED}
+    username: kibana_exporter
+  - name: kibana-2
+    template: cloud
+    labels:
+      env: prod
+    collectors: [unknown]
+`,
+			expected: []string{
+				"line 2: invalid port http for defaults: must be a number between 1 and 65535",
+				"line 4: invalid label name team-name for defaults",
+				"line 7: invalid timeout for template cloud: time: missing unit in duration \"5\"",
+				"line 10: undefined environment variable KIBANA_EXPORTER_UNDEFINED",
+				"line 16: unknown collector unknown for kibana-2, must be one of: task_manager, alerting, stats",
+			},
+		},
+		{
+			content: `kibanas:
+  - name: k1
+    labels: {level: prod}
+  - name: k2
+    labels:
+      host: kibana-2
+    collectors: [stats]
+  - name: k3
+    labels:
+      host: kibana-3
+`,
+			expected: []string{
+				"line 3: invalid label name level for k1: label of a metric",
+				"line 6: invalid label name host for k2: label of a metric of the stats collector",
+			},
+		},
+		{
+			content: `defaults:
+  tls_config:
+    server_name: kibana
+    key_fil: /etc/kibana.key
+kibanas:
+  - name: kibana-1
+    tls_config:
+      min_version: TLS12
+      ca_fil: /etc/ca.pem
+`,
+			expected: []string{
+				"line 4: unknown field key_fil in tls_config for defaults",
+				"line 9: unknown field ca_fil in tls_config for kibana-1",
+			},
+		},
+		{
+			content: `kibanas:
+  - name: kibana-1
+    port: [5601]
+    timeout: -5s
+`,
+			expected: []string{
+				"line 3: cannot unmarshal !!seq into string",
+				"line 4: invalid timeout for kibana-1: must not be negative",
+			},
+		},
+	} {
+		if err := ioutil.WriteFile(configFile, []byte(test.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, err = Load(configFile)
+		cerr, ok := err.(*ConfigError)
+		if !ok {
+			t.Fatalf("expected a *ConfigError, got: %v", err)
+		}
+		if strings.Join(cerr.Errors, "\n") != strings.Join(test.expected, "\n") {
+			t.Errorf("expected errors:\n%s\ngot:\n%s", strings.Join(test.expected, "\n"), strings.Join(cerr.Errors, "\n"))
+		}
+	}
+}
+
+func TestLabelNames(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"env":         true,
+		"_datacenter": true,
+		"team-name":   false,
+		"1team":       false,
+		"__name__":    false,
+		"level":       false,
+		"quantile":    false,
+		"percentile":  true,
+	} {
+		kibana := KibanaConfig{Name: "kibana", Labels: map[string]string{name: "value"}}
+		err := kibana.check()
+		if valid && err != nil {
+			t.Errorf("%s: expected valid config, got: %s", name, err)
+		}
+		if !valid && err == nil {
+			t.Errorf("%s: expected an error for invalid label name", name)
+		}
+	}
+}
+
+func TestCollectors(t *testing.T) {
+	for _, test := range []struct {
+		collectors []string
+		valid      bool
+	}{
+		{nil, true},
+		{[]string{CollectorTaskManager}, true},
+		{[]string{"unknown"}, false},
+		{[]string{CollectorTaskManager, CollectorTaskManager}, false},
+	} {
+		kibana := KibanaConfig{Name: "kibana", Collectors: test.collectors}
+		err := kibana.check()
+		if test.valid && err != nil {
+			t.Errorf("%v: expected valid config, got: %s", test.collectors, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%v: expected an error for invalid collectors", test.collectors)
+		}
+	}
+}
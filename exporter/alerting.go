@@ -0,0 +1,212 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/peekjef72/kibana-prometheus-exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// AlertingHealthStatuses lists every status of the checks of api/alerting/_health,
+// from the best to the worst.
+var AlertingHealthStatuses = []string{"ok", "warn", "error"}
+
+// AlertingFrameworkHealth is the status of each check of the alerting framework.
+type AlertingFrameworkHealth struct {
+	DecryptionHealth *AlertingCheck `json:"decryption_health,omitempty"`
+	ExecutionHealth  *AlertingCheck `json:"execution_health,omitempty"`
+	ReadHealth       *AlertingCheck `json:"read_health,omitempty"`
+}
+
+// AlertingCheck is the result of a check of the alerting framework.
+type AlertingCheck struct {
+	Status string `json:"status"`
+}
+
+// AlertingHealth is used to unmarshal the response of api/alerting/_health.
+type AlertingHealth struct {
+	IsSufficientlySecure      bool                     `json:"is_sufficiently_secure"`
+	HasPermanentEncryptionKey bool                     `json:"has_permanent_encryption_key"`
+	FrameworkHealth           *AlertingFrameworkHealth `json:"alerting_framework_health,omitempty"`
+	// misspelled name of 7.x, deprecated since 7.16
+	LegacyFrameworkHealth *AlertingFrameworkHealth `json:"alerting_framework_heath,omitempty"`
+}
+
+// checks returns the status of each check of the framework found in the response.
+func (h *AlertingHealth) checks() map[string]string {
+	framework := h.FrameworkHealth
+	if framework == nil {
+		framework = h.LegacyFrameworkHealth
+	}
+	checks := make(map[string]string, 3)
+	if framework == nil {
+		return checks
+	}
+	if framework.DecryptionHealth != nil {
+		checks["decryption"] = framework.DecryptionHealth.Status
+	}
+	if framework.ExecutionHealth != nil {
+		checks["execution"] = framework.ExecutionHealth.Status
+	}
+	if framework.ReadHealth != nil {
+		checks["read"] = framework.ReadHealth.Status
+	}
+	return checks
+}
+
+// AlertingRule holds the fields of a rule of api/alerting/rules/_find used
+// for the metrics.
+type AlertingRule struct {
+	RuleTypeId      string `json:"rule_type_id"`
+	Enabled         bool   `json:"enabled"`
+	ExecutionStatus struct {
+		// ok, active, error, pending, unknown or warning
+		Status string `json:"status"`
+		Error  *struct {
+			// read, decrypt, execute, license, timeout...
+			Reason string `json:"reason"`
+		} `json:"error,omitempty"`
+	} `json:"execution_status"`
+	// since 8.6
+	LastRun *struct {
+		// succeeded, warning or failed
+		Outcome string `json:"outcome"`
+	} `json:"last_run,omitempty"`
+}
+
+// alertingRulesPage is used to unmarshal a page of api/alerting/rules/_find.
+type alertingRulesPage struct {
+	Page    int            `json:"page"`
+	PerPage int            `json:"per_page"`
+	Total   int            `json:"total"`
+	Data    []AlertingRule `json:"data"`
+}
+
+// alertingRulesPerPage is the count of rules requested by page.
+const alertingRulesPerPage = 1000
+
+// scrapeAlerting requests api/alerting/_health and every page of
+// api/alerting/rules/_find from Kibana.
+func (c *KibanaCollector) scrapeAlerting(ctx context.Context) (*AlertingHealth, []AlertingRule, error) {
+	health := &AlertingHealth{}
+	if serr := c.fetch(ctx, "/api/alerting/_health", health); serr != nil {
+		return nil, nil, serr
+	}
+
+	rules := make([]AlertingRule, 0)
+	for page := 1; ; page++ {
+		resp := &alertingRulesPage{}
+		path := fmt.Sprintf("/api/alerting/rules/_find?per_page=%d&page=%d", alertingRulesPerPage, page)
+		if serr := c.fetch(ctx, path, resp); serr != nil {
+			return nil, nil, serr
+		}
+		rules = append(rules, resp.Data...)
+		// an empty page stops when rules are deleted meanwhile
+		if len(resp.Data) == 0 || len(rules) >= resp.Total {
+			break
+		}
+	}
+
+	return health, rules, nil
+}
+
+//*************************************************************************************************
+
+// alertingDescs holds the descriptions of the metrics of the alerting collector.
+type alertingDescs struct {
+	healthStatus     *prometheus.Desc
+	secure           *prometheus.Desc
+	encryptionKey    *prometheus.Desc
+	rules            *prometheus.Desc
+	rulesLastRun     *prometheus.Desc
+	rulesErrorReason *prometheus.Desc
+}
+
+func newAlertingDescs(namespace string) *alertingDescs {
+	return &alertingDescs{
+		healthStatus: newDesc(namespace, "alerting_health_status",
+			"Kibana alerting framework health of each check (decryption, execution, read) as a state set: 1 for the current status (ok, warn, error), 0 for the others", config.AlertingHealthLabels),
+		secure: newDesc(namespace, "alerting_sufficiently_secure",
+			"Kibana alerting framework has security and TLS enabled as needed by the rules (0: no, 1: yes)", nil),
+		encryptionKey: newDesc(namespace, "alerting_permanent_encryption_key",
+			"Kibana alerting framework has a permanent encryption key set (0: no, 1: yes)", nil),
+		rules: newDesc(namespace, "alerting_rules",
+			"Kibana alerting count of rules by rule type, enabled and execution status", config.AlertingRulesLabels),
+		rulesLastRun: newDesc(namespace, "alerting_rules_last_run",
+			"Kibana alerting count of rules by rule type and outcome of their last run (succeeded, warning, failed)", config.AlertingLastRunLabels),
+		rulesErrorReason: newDesc(namespace, "alerting_rules_errors",
+			"Kibana alerting count of rules in error by rule type and reason (read, decrypt, execute, license, timeout...)", config.AlertingErrorLabels),
+	}
+}
+
+// describe sends the descriptions of the metrics of the alerting collector.
+func (d *alertingDescs) describe(ch chan<- *prometheus.Desc) {
+	ch <- d.healthStatus
+	ch <- d.secure
+	ch <- d.encryptionKey
+	ch <- d.rules
+	ch <- d.rulesLastRun
+	ch <- d.rulesErrorReason
+}
+
+// boolValue converts a boolean to a gauge value.
+func boolValue(b bool) float64 {
+	if b {
+		return 1.0
+	}
+	return 0.0
+}
+
+// collectAlerting scrapes the alerting framework health and the rules of the
+// target and sends their metrics.
+func (e *Exporter) collectAlerting(ctx context.Context, target *KibanaCollector, ch chan<- prometheus.Metric) error {
+	health, rules, err := target.scrapeAlerting(ctx)
+	if err != nil {
+		return err
+	}
+	d := e.alerting
+
+	for check, current := range health.checks() {
+		known := false
+		for _, status := range AlertingHealthStatuses {
+			statusVal := 0.0
+			if status == current {
+				statusVal = 1.0
+				known = true
+			}
+			gauge(ch, d.healthStatus, statusVal, check, status)
+		}
+		if !known && current != "" {
+			gauge(ch, d.healthStatus, 1.0, check, current)
+		}
+	}
+	gauge(ch, d.secure, boolValue(health.IsSufficientlySecure))
+	gauge(ch, d.encryptionKey, boolValue(health.HasPermanentEncryptionKey))
+
+	// counts by label values
+	counts := make(map[[3]string]float64)
+	lastRuns := make(map[[2]string]float64)
+	errorReasons := make(map[[2]string]float64)
+	for _, rule := range rules {
+		counts[[3]string{rule.RuleTypeId, strconv.FormatBool(rule.Enabled), rule.ExecutionStatus.Status}]++
+		if rule.LastRun != nil && rule.LastRun.Outcome != "" {
+			lastRuns[[2]string{rule.RuleTypeId, rule.LastRun.Outcome}]++
+		}
+		if rule.ExecutionStatus.Error != nil {
+			errorReasons[[2]string{rule.RuleTypeId, rule.ExecutionStatus.Error.Reason}]++
+		}
+	}
+	for labels, count := range counts {
+		gauge(ch, d.rules, count, labels[:]...)
+	}
+	for labels, count := range lastRuns {
+		gauge(ch, d.rulesLastRun, count, labels[:]...)
+	}
+	for labels, count := range errorReasons {
+		gauge(ch, d.rulesErrorReason, count, labels[:]...)
+	}
+
+	return nil
+}
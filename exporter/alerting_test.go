@@ -0,0 +1,100 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/peekjef72/kibana-prometheus-exporter/config"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestAlerting(t *testing.T) {
+	registry, stop := newCollectorRegistry(t, config.CollectorAlerting, map[string]string{
+		"/api/status":               "status_v8.json",
+		"/api/alerting/_health":     "alerting_health.json",
+		"/api/alerting/rules/_find": "alerting_rules.json",
+	})
+	defer stop()
+
+	expected := `
+# HELP kibana_collector_up Kibana endpoint of the optional collector could be scraped (0: down, 1:up)
+# TYPE kibana_collector_up gauge
+kibana_collector_up{collector="alerting"} 1
+# HELP kibana_alerting_health_status Kibana alerting framework health of each check (decryption, execution, read) as a state set: 1 for the current status (ok, warn, error), 0 for the others
+# TYPE kibana_alerting_health_status gauge
+kibana_alerting_health_status{check="decryption",status="error"} 0
+kibana_alerting_health_status{check="decryption",status="ok"} 0
+kibana_alerting_health_status{check="decryption",status="warn"} 1
+kibana_alerting_health_status{check="execution",status="error"} 0
+kibana_alerting_health_status{check="execution",status="ok"} 1
+kibana_alerting_health_status{check="execution",status="warn"} 0
+kibana_alerting_health_status{check="read",status="error"} 0
+kibana_alerting_health_status{check="read",status="ok"} 1
+kibana_alerting_health_status{check="read",status="warn"} 0
+# HELP kibana_alerting_permanent_encryption_key Kibana alerting framework has a permanent encryption key set (0: no, 1: yes)
+# TYPE kibana_alerting_permanent_encryption_key gauge
+kibana_alerting_permanent_encryption_key 1
+# HELP kibana_alerting_rules Kibana alerting count of rules by rule type, enabled and execution status
+# TYPE kibana_alerting_rules gauge
+kibana_alerting_rules{enabled="false",rule_type=".es-query",status="pending"} 1
+kibana_alerting_rules{enabled="true",rule_type=".es-query",status="error"} 1
+kibana_alerting_rules{enabled="true",rule_type=".index-threshold",status="active"} 1
+kibana_alerting_rules{enabled="true",rule_type=".index-threshold",status="ok"} 1
+# HELP kibana_alerting_rules_last_run Kibana alerting count of rules by rule type and outcome of their last run (succeeded, warning, failed)
+# TYPE kibana_alerting_rules_last_run gauge
+kibana_alerting_rules_last_run{outcome="failed",rule_type=".es-query"} 1
+kibana_alerting_rules_last_run{outcome="succeeded",rule_type=".index-threshold"} 2
+# HELP kibana_alerting_rules_errors Kibana alerting count of rules in error by rule type and reason (read, decrypt, execute, license, timeout...)
+# TYPE kibana_alerting_rules_errors gauge
+kibana_alerting_rules_errors{reason="decrypt",rule_type=".es-query"} 1
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		"kibana_collector_up",
+		"kibana_alerting_health_status",
+		"kibana_alerting_permanent_encryption_key",
+		"kibana_alerting_rules",
+		"kibana_alerting_rules_last_run",
+		"kibana_alerting_rules_errors",
+	); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAlertingRulesPages(t *testing.T) {
+	// 3 rules on 2 pages, whatever per_page is
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/alerting/_health":
+			fmt.Fprint(w, `{"is_sufficiently_secure": true}`)
+		case "/api/alerting/rules/_find":
+			page := r.URL.Query().Get("page")
+			rules := `{"rule_type_id": ".es-query", "enabled": true}, {"rule_type_id": ".es-query", "enabled": true}`
+			if page == "2" {
+				rules = `{"rule_type_id": ".es-query", "enabled": false}`
+			} else if page != "1" {
+				rules = ""
+			}
+			fmt.Fprintf(w, `{"page": %s, "per_page": 2, "total": 3, "data": [%s]}`, page, rules)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	kibana := &config.KibanaConfig{Name: "kibana"}
+	collector := newKibanaCollector(t, kibana, server.URL)
+	health, rules, err := collector.scrapeAlerting(context.Background())
+	if err != nil {
+		t.Fatalf("scrapeAlerting failed: %s", err)
+	}
+	if !health.IsSufficientlySecure || len(health.checks()) != 0 {
+		t.Errorf("unexpected health %+v", health)
+	}
+	if len(rules) != 3 || rules[2].Enabled {
+		t.Errorf("expected the 3 rules of the 2 pages, got %+v", rules)
+	}
+}
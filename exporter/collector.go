@@ -1,13 +1,15 @@
 package exporter
 
 import (
-	"crypto/tls"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-kit/log"
@@ -16,11 +18,9 @@ import (
 )
 
 // KibanaCollector collects the Kibana information together to be used by
-// the exporter to scrape metrics.
+// the exporter to scrape metrics. It is shared by all the scrapes of the same
+// target, that may run concurrently: it must not keep any per-scrape state.
 type KibanaCollector struct {
-	// state of the client reachable or not
-	State bool
-
 	// config of the Kibana instance or the service
 	kibana config.KibanaConfig
 	// reference to global looger
@@ -30,14 +30,70 @@ type KibanaCollector struct {
 	// for the "Authorization" header. If this is empty, it is
 	// assumed that no authorization is needed.
 	authHeader string
+	// authFile holds the secret of the auth method authScheme when it
+	// is read from a file: the header is then built on each scrape.
+	authScheme string
+	authFile   string
 
 	// client is the http.Client that will be used to make
 	// requests to collect the Kibana metrics
 	client *http.Client
+
+	// scrape errors count by reason, protected by lock
+	lock         sync.Mutex
+	scrapeErrors map[string]float64
+	// api/stats rejected exclude_usage, protected by lock
+	noExcludeUsage bool
+	// identifiers of the last successful scrape of api/stats for the labels
+	// of kibana_info (config.StatsInfoLabels), protected by lock
+	statsIdentifiers []string
+}
+
+// reasons of scrape failures, used as label values of the scrape errors counter
+const (
+	// Kibana can't be reached or the response can't be read
+	ScrapeErrorConnect = "connect"
+	// Kibana answered with a status code other than 200
+	ScrapeErrorHttpStatus = "http_status"
+	// the response is not a valid api/status content
+	ScrapeErrorDecode = "decode"
+	// the credentials file can't be read
+	ScrapeErrorCredentials = "credentials"
+)
+
+var ScrapeErrorReasons = []string{ScrapeErrorConnect, ScrapeErrorHttpStatus, ScrapeErrorDecode, ScrapeErrorCredentials}
+
+// ScrapeError is the error returned by scrape(); Reason is one of ScrapeErrorReasons.
+type ScrapeError struct {
+	Reason string
+	Err    error
+	// HTTP status of the response, 0 if Kibana didn't answer
+	StatusCode int
+}
+
+func (e *ScrapeError) Error() string {
+	return e.Err.Error()
+}
+
+// status formats returned by api/status
+const (
+	// 7.x legacy format: status.overall.state is green, yellow or red
+	StatusFormatV7 = "v7"
+	// 8.x format (or 7.x with ?v8format=true): status.overall.level is
+	// available, degraded, unavailable or critical
+	StatusFormatV8 = "v8"
+)
+
+// StatusLevels lists every overall status a format can report, from the best
+// to the worst.
+var StatusLevels = map[string][]string{
+	StatusFormatV7: {"green", "yellow", "red"},
+	StatusFormatV8: {"available", "degraded", "unavailable", "critical"},
 }
 
 //"version":{"number":"7.17.1","build_hash":"78e8422ed4e7d2054bd35b82a91299b3f7bd6231","build_number":46635,"build_snapshot":false},
 //"status":{"overall":{"since":"2022-03-06T10:35:22.586Z","state":"yellow","title":"Yellow","nickname":"I'll be back","icon":"warning","uiColor":"warning"}
+//"status":{"overall":{"level":"available","summary":"All services are available"}
 // KibanaMetrics is used to unmarshal the metrics response from Kibana.
 type KibanaMetrics struct {
 	VersionPart struct {
@@ -46,8 +102,19 @@ type KibanaMetrics struct {
 	} `json:"version"`
 	Status struct {
 		Overall struct {
-			State string `json:"state"`
+			// 7.x legacy format
+			State string `json:"state,omitempty"`
+			// 8.x format
+			Level string `json:"level,omitempty"`
 		} `json:"overall"`
+		// 8.x format: services status by name
+		Core    map[string]ServiceStatus `json:"core,omitempty"`
+		Plugins map[string]ServiceStatus `json:"plugins,omitempty"`
+		// 7.x legacy format: id is like "core:elasticsearch@7.17.1" or "plugin:alerting@7.17.1"
+		Statuses []struct {
+			Id    string `json:"id"`
+			State string `json:"state"`
+		} `json:"statuses,omitempty"`
 	} `json:"status"`
 	Metrics struct {
 		ConcurrentConnections int `json:"concurrent_connections"`
@@ -57,15 +124,58 @@ type KibanaMetrics struct {
 				Heap struct {
 					TotalInBytes int64 `json:"total_in_bytes"`
 					UsedInBytes  int64 `json:"used_in_bytes"`
+					SizeLimit    int64 `json:"size_limit"`
 				} `json:"heap"`
+				ResidentSetSizeInBytes int64 `json:"resident_set_size_in_bytes"`
 			} `json:"memory"`
+			// event loop metrics in milliseconds, missing in older versions
+			EventLoopDelay          *float64 `json:"event_loop_delay,omitempty"`
+			EventLoopDelayHistogram *struct {
+				Min    float64 `json:"min"`
+				Max    float64 `json:"max"`
+				Mean   float64 `json:"mean"`
+				Stddev float64 `json:"stddev"`
+				// delays by percentile: "50", "75", "95", "99"
+				Percentiles map[string]float64 `json:"percentiles"`
+			} `json:"event_loop_delay_histogram,omitempty"`
+			EventLoopUtilization *struct {
+				Active      float64 `json:"active"`
+				Idle        float64 `json:"idle"`
+				Utilization float64 `json:"utilization"`
+			} `json:"event_loop_utilization,omitempty"`
 		} `json:"process"`
 		Os struct {
-			Load struct {
+			Platform        string `json:"platform"`
+			PlatformRelease string `json:"platformRelease"`
+			Load            struct {
 				Load1m  float64 `json:"1m"`
 				Load5m  float64 `json:"5m"`
 				Load15m float64 `json:"15m"`
 			} `json:"load"`
+			Memory struct {
+				TotalInBytes int64 `json:"total_in_bytes"`
+				FreeInBytes  int64 `json:"free_in_bytes"`
+				UsedInBytes  int64 `json:"used_in_bytes"`
+			} `json:"memory"`
+			UptimeInMillis float64 `json:"uptime_in_millis"`
+			// cgroup stats, only when Kibana runs in a container
+			Cpuacct *struct {
+				UsageNanos float64 `json:"usage_nanos"`
+			} `json:"cpuacct,omitempty"`
+			Cpu *struct {
+				CfsPeriodMicros float64 `json:"cfs_period_micros"`
+				CfsQuotaMicros  float64 `json:"cfs_quota_micros"`
+				Stat            struct {
+					NumberOfElapsedPeriods float64 `json:"number_of_elapsed_periods"`
+					NumberOfTimesThrottled float64 `json:"number_of_times_throttled"`
+					TimeThrottledNanos     float64 `json:"time_throttled_nanos"`
+				} `json:"stat"`
+			} `json:"cpu,omitempty"`
+			// cgroup v2 only
+			CgroupMemory *struct {
+				CurrentInBytes     float64  `json:"current_in_bytes"`
+				SwapCurrentInBytes *float64 `json:"swap_current_in_bytes,omitempty"`
+			} `json:"cgroup_memory,omitempty"`
 		} `json:"os"`
 		ResponseTimes struct {
 			AvgInMillis float64 `json:"avg_in_millis"`
@@ -78,12 +188,91 @@ type KibanaMetrics struct {
 	} `json:"metrics"`
 }
 
+// ServiceStatus is the status of a core service or a plugin in the 8.x format.
+type ServiceStatus struct {
+	Level   string `json:"level"`
+	Summary string `json:"summary,omitempty"`
+}
+
+// KibanaService is the status of a core service or a plugin, whatever the
+// format of the response.
+type KibanaService struct {
+	Name string
+	// "core" or "plugin"
+	Kind string
+	// state (v7) or level (v8) in lower case
+	Level string
+}
+
+// StatusFormat returns the format of the status part of the response:
+// StatusFormatV8 when the overall level is set, StatusFormatV7 otherwise.
+func (m *KibanaMetrics) StatusFormat() string {
+	if m.Status.Overall.Level != "" {
+		return StatusFormatV8
+	}
+	return StatusFormatV7
+}
+
+// OverallStatus returns the overall state (v7) or level (v8) in lower case.
+func (m *KibanaMetrics) OverallStatus() string {
+	if m.StatusFormat() == StatusFormatV8 {
+		return strings.ToLower(m.Status.Overall.Level)
+	}
+	return strings.ToLower(m.Status.Overall.State)
+}
+
+// IsAvailable returns true when Kibana reports itself as fully operational:
+// "green" for the 7.x format, "available" for the 8.x one.
+func (m *KibanaMetrics) IsAvailable() bool {
+	return isAvailableStatus(m.OverallStatus())
+}
+
+// Services returns the status of every core service and plugin listed in the
+// response, sorted by kind and name.
+func (m *KibanaMetrics) Services() []KibanaService {
+	services := make([]KibanaService, 0, len(m.Status.Core)+len(m.Status.Plugins)+len(m.Status.Statuses))
+	for name, status := range m.Status.Core {
+		services = append(services, KibanaService{Name: name, Kind: "core", Level: strings.ToLower(status.Level)})
+	}
+	for name, status := range m.Status.Plugins {
+		services = append(services, KibanaService{Name: name, Kind: "plugin", Level: strings.ToLower(status.Level)})
+	}
+	for _, status := range m.Status.Statuses {
+		// "core:elasticsearch@7.17.1" => kind "core", name "elasticsearch"
+		id := status.Id
+		if i := strings.LastIndex(id, "@"); i > 0 {
+			id = id[:i]
+		}
+		kind, name := "plugin", id
+		if i := strings.Index(id, ":"); i >= 0 {
+			kind, name = id[:i], id[i+1:]
+		}
+		services = append(services, KibanaService{Name: name, Kind: kind, Level: strings.ToLower(status.State)})
+	}
+	sort.Slice(services, func(i, j int) bool {
+		if services[i].Kind != services[j].Kind {
+			return services[i].Kind < services[j].Kind
+		}
+		return services[i].Name < services[j].Name
+	})
+	return services
+}
+
+// isAvailableStatus tells if a state (v7) or level (v8) is the nominal one.
+func isAvailableStatus(status string) bool {
+	switch status {
+	case "green", "available":
+		return true
+	}
+	return false
+}
+
 // TestConnection checks whether the connection to Kibana is healthy
 func (c *KibanaCollector) TestConnection(logger log.Logger) bool {
 	level.Debug(logger).
 		Log("msg", "checking for kibana status")
 
-	_, err := c.scrape()
+	_, err := c.scrape(context.Background())
 	if err != nil {
 		level.Info(logger).
 			Log("msg", fmt.Sprintf("test connection to kibana failed: %s", err))
@@ -111,11 +300,36 @@ func (c *KibanaCollector) WaitForConnection(logger log.Logger) {
 	}
 }
 
+// idleConnTimeout is the time a connection to Kibana is kept for the next
+// scrapes, like http.DefaultTransport.
+const idleConnTimeout = 90 * time.Second
+
 // NewCollector builds a KibanaCollector struct
 func NewCollector(kibana *config.KibanaConfig, logger log.Logger) (*KibanaCollector, error) {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
 	collector := &KibanaCollector{}
 	collector.kibana = *kibana
 	collector.logger = logger
+	collector.scrapeErrors = make(map[string]float64, len(ScrapeErrorReasons))
+	for _, reason := range ScrapeErrorReasons {
+		collector.scrapeErrors[reason] = 0
+	}
+
+	// proxy_url, no_proxy or the proxy environment variables
+	tr := &http.Transport{
+		Proxy:           kibana.Proxy(),
+		IdleConnTimeout: idleConnTimeout,
+	}
+	if kibana.ProxyURL != "" {
+		level.Debug(logger).
+			Log("msg", fmt.Sprintf("using proxy %s for Kibana URL: %s", kibana.ProxyURL, kibana.Url()))
+	}
+	collector.client = &http.Client{
+		Transport: tr,
+	}
+
 	if strings.HasPrefix(kibana.Protocol, "https") {
 		level.Debug(logger).
 			Log("msg", fmt.Sprintf("kibana URL is a TLS one: %s", kibana.Url()))
@@ -125,29 +339,54 @@ func NewCollector(kibana *config.KibanaConfig, logger log.Logger) (*KibanaCollec
 				Log("msg", fmt.Sprintf("skipping TLS verification for Kibana URL: %s", kibana.Url()))
 		}
 
-		tConf := &tls.Config{
-			InsecureSkipVerify: kibana.SkipTls(),
-		}
-
-		tr := &http.Transport{
-			TLSClientConfig: tConf,
-		}
-
-		collector.client = &http.Client{
-			Transport: tr,
+		tConf, err := kibana.TLSClientConfig()
+		if err != nil {
+			return nil, fmt.Errorf("invalid TLS config for Kibana URL %s: %s", kibana.Url(), err)
 		}
+		tr.TLSClientConfig = tConf
 	} else {
 		level.Debug(logger).
 			Log("msg", fmt.Sprintf("kibana URL is a plain text one: %s", kibana.Url()))
 
-		collector.client = &http.Client{}
 		if kibana.SkipTls() {
 			level.Info(logger).
 				Log("msg", fmt.Sprintf("kibana.skip-tls is enabled for an http URL, ignoring: %s", kibana.Url()))
 		}
+		if kibana.TLSConfig != nil {
+			level.Info(logger).
+				Log("msg", fmt.Sprintf("tls_config is set for an http URL, ignoring: %s", kibana.Url()))
+		}
 	}
 
-	if kibana.Username != "" && kibana.Password != "" {
+	if kibana.ApiKeyFile != "" {
+		level.Debug(logger).
+			Log("msg", fmt.Sprintf("using API key authenticated requests with Kibana, key read from %s", kibana.ApiKeyFile))
+
+		collector.authScheme = "ApiKey"
+		collector.authFile = kibana.ApiKeyFile
+	} else if kibana.ApiKey != "" {
+		level.Debug(logger).
+			Log("msg", "using API key authenticated requests with Kibana")
+
+		collector.authHeader = fmt.Sprintf("ApiKey %s", kibana.ApiKey)
+	} else if kibana.BearerTokenFile != "" {
+		level.Debug(logger).
+			Log("msg", fmt.Sprintf("using bearer token authenticated requests with Kibana, token read from %s", kibana.BearerTokenFile))
+
+		collector.authScheme = "Bearer"
+		collector.authFile = kibana.BearerTokenFile
+	} else if kibana.BearerToken != "" {
+		level.Debug(logger).
+			Log("msg", "using bearer token authenticated requests with Kibana")
+
+		collector.authHeader = fmt.Sprintf("Bearer %s", kibana.BearerToken)
+	} else if kibana.Username != "" && kibana.PasswordFile != "" {
+		level.Debug(logger).
+			Log("msg", fmt.Sprintf("using authenticated requests with Kibana, password read from %s", kibana.PasswordFile))
+
+		collector.authScheme = "Basic"
+		collector.authFile = kibana.PasswordFile
+	} else if kibana.Username != "" && kibana.Password != "" {
 		level.Debug(logger).
 			Log("msg", "using authenticated requests with Kibana")
 
@@ -156,61 +395,236 @@ func NewCollector(kibana *config.KibanaConfig, logger log.Logger) (*KibanaCollec
 		collector.authHeader = fmt.Sprintf("Basic %s", encCreds)
 	} else {
 		level.Info(logger).
-			Log("msg", "Kibana username or password is not provided, assuming unauthenticated communication")
+			Log("msg", "Kibana API key, bearer token, username or password is not provided, assuming unauthenticated communication")
 	}
 
 	return collector, nil
 }
 
+// ScrapeErrors returns a copy of the scrape errors count by reason.
+func (c *KibanaCollector) ScrapeErrors() map[string]float64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	errs := make(map[string]float64, len(ScrapeErrorReasons))
+	for _, reason := range ScrapeErrorReasons {
+		errs[reason] = c.scrapeErrors[reason]
+	}
+	return errs
+}
+
+// runs tells if the optional collector name runs for the target.
+func (c *KibanaCollector) runs(name string) bool {
+	for _, collector := range c.kibana.Collectors {
+		if collector == name {
+			return true
+		}
+	}
+	return false
+}
+
+// closeIdleConnections closes the connections to Kibana kept for the next scrapes.
+func (c *KibanaCollector) closeIdleConnections() {
+	c.client.CloseIdleConnections()
+}
+
+// countScrapeError counts a failure of a scrape of api/status.
+func (c *KibanaCollector) countScrapeError(reason string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.scrapeErrors == nil {
+		c.scrapeErrors = make(map[string]float64, len(ScrapeErrorReasons))
+	}
+	c.scrapeErrors[reason]++
+}
+
+// newScrapeError builds a ScrapeError.
+func newScrapeError(reason string, format string, args ...interface{}) *ScrapeError {
+	return &ScrapeError{Reason: reason, Err: fmt.Errorf(format, args...)}
+}
+
+// authorization returns the value of the "Authorization" header; when the
+// secret is held by a file, it is read each time to follow rotations.
+func (c *KibanaCollector) authorization() (string, error) {
+	if c.authFile == "" {
+		return c.authHeader, nil
+	}
+	secret, err := config.ReadSecretFile(c.authFile)
+	if err != nil {
+		return "", err
+	}
+	if c.authScheme == "Basic" {
+		creds := fmt.Sprintf("%s:%s", c.kibana.Username, secret)
+		secret = base64.StdEncoding.EncodeToString([]byte(creds))
+	}
+	return fmt.Sprintf("%s %s", c.authScheme, secret), nil
+}
+
+// Name is the name of the target in the config, or its URL when scraped by URL.
+func (c *KibanaCollector) Name() string {
+	return c.kibana.Name
+}
+
+// Url is the URL of Kibana.
+func (c *KibanaCollector) Url() string {
+	return c.kibana.Url()
+}
+
+// ProbeResult is the outcome of a probe of a target.
+type ProbeResult struct {
+	Name string `json:"name"`
+	Url  string `json:"url"`
+	// Kibana answered, whatever the HTTP status
+	Reachable  bool    `json:"reachable"`
+	HttpStatus int     `json:"http_status,omitempty"`
+	Version    string  `json:"version,omitempty"`
+	Status     string  `json:"status,omitempty"`
+	Latency    float64 `json:"latency_seconds"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// Failed tells if the target could not be scraped.
+func (r *ProbeResult) Failed() bool {
+	return r.Error != ""
+}
+
+// Probe scrapes the target once, out of a Prometheus scrape.
+func (c *KibanaCollector) Probe(ctx context.Context) *ProbeResult {
+	result := &ProbeResult{
+		Name: c.Name(),
+		Url:  c.Url(),
+	}
+	start := time.Now()
+	metrics, err := c.scrape(ctx)
+	result.Latency = time.Since(start).Seconds()
+	if err != nil {
+		result.Error = err.Error()
+		if serr, ok := err.(*ScrapeError); ok && serr.StatusCode != 0 {
+			result.Reachable = true
+			result.HttpStatus = serr.StatusCode
+		}
+		return result
+	}
+	result.Reachable = true
+	result.HttpStatus = http.StatusOK
+	result.Version = metrics.VersionPart.Version
+	result.Status = metrics.OverallStatus()
+	return result
+}
+
+// ProbeAll probes the targets concurrently; the results are in the order
+// of the targets.
+func ProbeAll(ctx context.Context, targets []*KibanaCollector) []*ProbeResult {
+	results := make([]*ProbeResult, len(targets))
+	var wg sync.WaitGroup
+	for index, target := range targets {
+		wg.Add(1)
+		go func(index int, target *KibanaCollector) {
+			defer wg.Done()
+			results[index] = target.Probe(ctx)
+		}(index, target)
+	}
+	wg.Wait()
+	return results
+}
+
+// ScrapeTimeout is the ceiling of the duration of a scrape of the target.
+func (c *KibanaCollector) ScrapeTimeout() time.Duration {
+	return c.kibana.ScrapeTimeout()
+}
+
 // scrape will connect to the Kibana instance, using the details
 // provided by the KibanaCollector struct, and return the metrics as a
 // KibanaMetrics representation.
-func (c *KibanaCollector) scrape() (*KibanaMetrics, error) {
+// The request is canceled when ctx is done or when the timeout of the
+// target is reached.
+func (c *KibanaCollector) scrape(ctx context.Context) (*KibanaMetrics, error) {
+	path := "/api/status"
+	if c.kibana.V8StatusFormat() {
+		// ask 7.x instances to use the 8.x format; ignored by 8.x
+		path += "?v8format=true"
+	}
+
+	metrics := &KibanaMetrics{}
+	if serr := c.fetch(ctx, path, metrics); serr != nil {
+		c.countScrapeError(serr.Reason)
+		return nil, serr
+	}
+
+	return metrics, nil
+}
+
+// fetch requests path (with its query) from Kibana and decodes the json
+// response into out; the errors are not counted.
+// The request is canceled when ctx is done or when the timeout of the
+// target is reached.
+func (c *KibanaCollector) fetch(ctx context.Context, path string, out interface{}) *ScrapeError {
+	if timeout := c.kibana.ScrapeTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
 	level.Debug(c.logger).
-		Log("msg", "building request for api/status from kibana")
+		Log("msg", fmt.Sprintf("building request for %s from kibana", path))
 
-	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/api/status", c.kibana.Url()), nil)
+	req, err := http.NewRequest(http.MethodGet, c.kibana.Url()+path, nil)
 	if err != nil {
-		return nil, fmt.Errorf("could not initialize a request to scrape metrics: %s", err)
+		return newScrapeError(ScrapeErrorConnect, "could not initialize a request to scrape metrics: %s", err)
 	}
+	req = req.WithContext(ctx)
 
-	if c.authHeader != "" {
+	authHeader, err := c.authorization()
+	if err != nil {
+		return newScrapeError(ScrapeErrorCredentials, "could not read credentials from %s: %s", c.authFile, err)
+	}
+	if authHeader != "" {
 		level.Debug(c.logger).
 			Log("msg", "adding auth header")
-		req.Header.Add("Authorization", c.authHeader)
+		req.Header.Add("Authorization", authHeader)
 	}
 
 	req.Header.Add("Accept", "application/json")
 
+	for name, value := range c.kibana.Headers {
+		if http.CanonicalHeaderKey(name) == "Host" {
+			// virtual host routing of reverse proxies
+			req.Host = value
+			continue
+		}
+		req.Header.Set(name, value)
+	}
+
 	level.Debug(c.logger).
-		Log("msg", "requesting api/status from kibana")
+		Log("msg", fmt.Sprintf("requesting %s from kibana", path))
 	resp, err := c.client.Do(req)
 	if err != nil {
-		c.State = false
-		return nil, fmt.Errorf("error while reading Kibana status: %s", err)
+		return newScrapeError(ScrapeErrorConnect, "error while reading Kibana %s: %s", path, err)
 	}
-	c.State = true
-
 	defer resp.Body.Close()
 
 	level.Debug(c.logger).
-		Log("msg", "processing api/status response")
+		Log("msg", fmt.Sprintf("processing %s response", path))
 
 	if resp.StatusCode != http.StatusOK {
-		c.State = false
-		return nil, fmt.Errorf("invalid response from Kibana status: %s", resp.Status)
+		serr := newScrapeError(ScrapeErrorHttpStatus, "invalid response from Kibana %s: %s", path, resp.Status)
+		serr.StatusCode = resp.StatusCode
+		return serr
 	}
 
 	respContent, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("error while reading response from Kibana status: %s", err)
+		serr := newScrapeError(ScrapeErrorConnect, "error while reading response from Kibana %s: %s", path, err)
+		serr.StatusCode = resp.StatusCode
+		return serr
 	}
 
-	metrics := &KibanaMetrics{}
-	err = json.Unmarshal(respContent, &metrics)
+	err = json.Unmarshal(respContent, out)
 	if err != nil {
-		return nil, fmt.Errorf("error while unmarshalling Kibana status: %s\nProblematic content:\n%s", err, respContent)
+		serr := newScrapeError(ScrapeErrorDecode, "error while unmarshalling Kibana %s: %s\nProblematic content:\n%s", path, err, respContent)
+		serr.StatusCode = resp.StatusCode
+		return serr
 	}
 
-	return metrics, nil
+	return nil
 }
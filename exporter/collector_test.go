@@ -1,7 +1,25 @@
 package exporter
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	stdlog "log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/peekjef72/kibana-prometheus-exporter/config"
 )
@@ -111,3 +129,580 @@ func TestNewCollectorAuthHeader(t *testing.T) {
 		})
 	}
 }
+
+// newStatusServer starts a fake Kibana serving the given api/status fixture
+// from testdata; the received query strings are sent to queries if not nil.
+func newStatusServer(t *testing.T, fixture string, queries chan<- string) *httptest.Server {
+	content, err := ioutil.ReadFile(filepath.Join("testdata", fixture))
+	if err != nil {
+		t.Fatalf("can't read fixture %s: %s", fixture, err)
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/status" {
+			http.NotFound(w, r)
+			return
+		}
+		if queries != nil {
+			queries <- r.URL.RawQuery
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(content) // nolint: errcheck
+	}))
+}
+
+// newKibanaServer starts a fake Kibana serving a fixture from testdata for
+// each path; the other paths are not found.
+func newKibanaServer(t *testing.T, fixtures map[string]string) *httptest.Server {
+	contents := make(map[string][]byte, len(fixtures))
+	for path, fixture := range fixtures {
+		content, err := ioutil.ReadFile(filepath.Join("testdata", fixture))
+		if err != nil {
+			t.Fatalf("can't read fixture %s: %s", fixture, err)
+		}
+		contents[path] = content
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, ok := contents[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(content) // nolint: errcheck
+	}))
+}
+
+// status format tests
+var statusFormatTests = []struct {
+	desc, fixture, v8format         string
+	format, overall, version, query string
+	available                       bool
+}{
+	{
+		desc:      "7.x legacy format",
+		fixture:   "status_v7.json",
+		format:    StatusFormatV7,
+		overall:   "yellow",
+		version:   "7.17.1",
+		query:     "",
+		available: false,
+	},
+	{
+		desc:      "7.x requesting 8.x format",
+		fixture:   "status_v8.json",
+		v8format:  "yes",
+		format:    StatusFormatV8,
+		overall:   "available",
+		version:   "8.1.0",
+		query:     "v8format=true",
+		available: true,
+	},
+	{
+		desc:      "8.x format",
+		fixture:   "status_v8.json",
+		format:    StatusFormatV8,
+		overall:   "available",
+		version:   "8.1.0",
+		query:     "",
+		available: true,
+	},
+}
+
+func TestScrapeStatusFormats(t *testing.T) {
+	for _, st := range statusFormatTests {
+		t.Run(st.desc, func(t *testing.T) {
+			queries := make(chan string, 1)
+			server := newStatusServer(t, st.fixture, queries)
+			defer server.Close()
+
+			kibana := &config.KibanaConfig{
+				Name:     "default",
+				V8Format: st.v8format,
+			}
+			collector := newKibanaCollector(t, kibana, server.URL)
+			metrics, err := collector.scrape(context.Background())
+			if err != nil {
+				t.Fatalf("scrape failed: %s", err)
+			}
+			if query := <-queries; query != st.query {
+				t.Errorf("expected query %q, got %q", st.query, query)
+			}
+			if metrics.StatusFormat() != st.format {
+				t.Errorf("expected format %s, got %s", st.format, metrics.StatusFormat())
+			}
+			if metrics.OverallStatus() != st.overall {
+				t.Errorf("expected overall status %s, got %s", st.overall, metrics.OverallStatus())
+			}
+			if metrics.IsAvailable() != st.available {
+				t.Errorf("expected available %t, got %t", st.available, metrics.IsAvailable())
+			}
+			if metrics.VersionPart.Version != st.version {
+				t.Errorf("expected version %s, got %s", st.version, metrics.VersionPart.Version)
+			}
+		})
+	}
+}
+
+func TestServices(t *testing.T) {
+	expected := map[string][]KibanaService{
+		"status_v7.json": {
+			{Name: "elasticsearch", Kind: "core", Level: "green"},
+			{Name: "savedObjects", Kind: "core", Level: "green"},
+			{Name: "alerting", Kind: "plugin", Level: "yellow"},
+			{Name: "taskManager", Kind: "plugin", Level: "green"},
+		},
+		"status_v8.json": {
+			{Name: "elasticsearch", Kind: "core", Level: "available"},
+			{Name: "savedObjects", Kind: "core", Level: "available"},
+			{Name: "alerting", Kind: "plugin", Level: "degraded"},
+			{Name: "taskManager", Kind: "plugin", Level: "available"},
+		},
+	}
+	for fixture, services := range expected {
+		t.Run(fixture, func(t *testing.T) {
+			content, err := ioutil.ReadFile(filepath.Join("testdata", fixture))
+			if err != nil {
+				t.Fatalf("can't read fixture %s: %s", fixture, err)
+			}
+			metrics := &KibanaMetrics{}
+			if err := json.Unmarshal(content, metrics); err != nil {
+				t.Fatalf("can't unmarshal fixture %s: %s", fixture, err)
+			}
+			if got := metrics.Services(); !reflect.DeepEqual(got, services) {
+				t.Errorf("expected services %v, got %v", services, got)
+			}
+		})
+	}
+}
+
+// scrape timeout tests: the fake Kibana never answers before the test ends
+var timeoutTests = []struct {
+	desc, timeout string
+	ctxTimeout    time.Duration
+}{
+	{
+		desc:    "target timeout",
+		timeout: "100ms",
+	},
+	{
+		desc:       "context deadline shorter than target timeout",
+		timeout:    "1m",
+		ctxTimeout: 100 * time.Millisecond,
+	},
+}
+
+func TestScrapeTimeout(t *testing.T) {
+	for _, tt := range timeoutTests {
+		t.Run(tt.desc, func(t *testing.T) {
+			done := make(chan struct{})
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				<-done
+			}))
+			defer server.Close()
+			defer close(done)
+
+			kibana := &config.KibanaConfig{
+				Name:    "default",
+				Timeout: tt.timeout,
+			}
+			collector := newKibanaCollector(t, kibana, server.URL)
+
+			ctx := context.Background()
+			if tt.ctxTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.ctxTimeout)
+				defer cancel()
+			}
+			start := time.Now()
+			_, err := collector.scrape(ctx)
+			if err == nil {
+				t.Fatalf("scrape of a hung Kibana should fail")
+			}
+			if serr, ok := err.(*ScrapeError); !ok || serr.Reason != ScrapeErrorConnect {
+				t.Errorf("expected a %s scrape error, got %s", ScrapeErrorConnect, err)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("scrape should have been canceled, took %s", elapsed)
+			}
+		})
+	}
+}
+
+// auth methods tests
+var authMethodTests = []struct {
+	desc, username, password, apiKey, bearerToken, header string
+}{
+	{
+		desc:     "basic auth",
+		username: "kibanau",
+		password: "kibanap",
+		header:   "Basic a2liYW5hdTpraWJhbmFw",
+	},
+	{
+		desc:   "api key",
+		apiKey: "VnVhQ2ZHY0JDZGJrUW0tZTVhT3g6dWkybHAyYXhUTm1zeWFrdzl0dk5udw==",
+		header: "ApiKey VnVhQ2ZHY0JDZGJrUW0tZTVhT3g6dWkybHAyYXhUTm1zeWFrdzl0dk5udw==",
+	},
+	{
+		desc:        "bearer token",
+		bearerToken: "dGhpcyBpcyBub3QgYSByZWFsIHRva2Vu",
+		header:      "Bearer dGhpcyBpcyBub3QgYSByZWFsIHRva2Vu",
+	},
+}
+
+func TestAuthMethods(t *testing.T) {
+	for _, at := range authMethodTests {
+		t.Run(at.desc, func(t *testing.T) {
+			headers := make(chan string, 1)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				headers <- r.Header.Get("Authorization")
+				w.Write([]byte(`{"status":{"overall":{"level":"available"}}}`)) // nolint: errcheck
+			}))
+			defer server.Close()
+
+			kibana := &config.KibanaConfig{
+				Name:        "default",
+				Username:    at.username,
+				Password:    at.password,
+				ApiKey:      at.apiKey,
+				BearerToken: at.bearerToken,
+			}
+			collector := newKibanaCollector(t, kibana, server.URL)
+			if _, err := collector.scrape(context.Background()); err != nil {
+				t.Fatalf("scrape failed: %s", err)
+			}
+			if header := <-headers; header != at.header {
+				t.Errorf("expected Authorization header %q, got %q", at.header, header)
+			}
+		})
+	}
+}
+
+func TestAuthFileRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kibana-exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "api_key")
+	if err := ioutil.WriteFile(keyFile, []byte("Zmlyc3Q=\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	headers := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Get("Authorization")
+		w.Write([]byte(`{"status":{"overall":{"level":"available"}}}`)) // nolint: errcheck
+	}))
+	defer server.Close()
+
+	kibana := &config.KibanaConfig{
+		Name:       "default",
+		ApiKeyFile: keyFile,
+	}
+	collector := newKibanaCollector(t, kibana, server.URL)
+
+	for _, key := range []string{"Zmlyc3Q=", "c2Vjb25k"} {
+		if err := ioutil.WriteFile(keyFile, []byte(key+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := collector.scrape(context.Background()); err != nil {
+			t.Fatalf("scrape failed: %s", err)
+		}
+		if header := <-headers; header != "ApiKey "+key {
+			t.Errorf("expected Authorization header %q, got %q", "ApiKey "+key, header)
+		}
+	}
+
+	// the secret is gone: the scrape fails before sending the request
+	os.Remove(keyFile)
+	_, err = collector.scrape(context.Background())
+	if serr, ok := err.(*ScrapeError); !ok || serr.Reason != ScrapeErrorCredentials {
+		t.Errorf("expected a %s scrape error, got %v", ScrapeErrorCredentials, err)
+	}
+}
+
+// writeCert generates a key and a certificate signed by parent (self-signed
+// when parent is nil) and writes them as PEM files in dir.
+func writeCert(t *testing.T, dir, name string, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// mutual TLS tests: the fake Kibana has a certificate for kibana.local signed
+// by a private CA and requires a client certificate signed by the same CA.
+var tlsTests = []struct {
+	desc      string
+	skip      bool
+	tlsConfig *config.TLSConfig
+	valid     bool
+}{
+	{
+		desc:  "no tls_config",
+		valid: false,
+	},
+	{
+		desc:      "CA without client certificate",
+		tlsConfig: &config.TLSConfig{CAFile: "ca.crt", ServerName: "kibana.local"},
+		valid:     false,
+	},
+	{
+		desc:      "client certificate without server name",
+		tlsConfig: &config.TLSConfig{CAFile: "ca.crt", CertFile: "client.crt", KeyFile: "client.key"},
+		valid:     false,
+	},
+	{
+		desc:      "client certificate",
+		tlsConfig: &config.TLSConfig{CAFile: "ca.crt", CertFile: "client.crt", KeyFile: "client.key", ServerName: "kibana.local", MinVersion: "TLS12"},
+		valid:     true,
+	},
+	{
+		desc:      "client certificate and skip-tls",
+		skip:      true,
+		tlsConfig: &config.TLSConfig{CertFile: "client.crt", KeyFile: "client.key"},
+		valid:     true,
+	},
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kibana-exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	notAfter := time.Now().Add(time.Hour)
+	ca, caKey := writeCert(t, dir, "ca", &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil, nil)
+	writeCert(t, dir, "server", &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "kibana.local"},
+		DNSNames:     []string{"kibana.local"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	writeCert(t, dir, "client", &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "kibana_exporter"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	serverCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status":{"overall":{"level":"available"}}}`)) // nolint: errcheck
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	server.Config.ErrorLog = stdlog.New(ioutil.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+
+	for _, tt := range tlsTests {
+		t.Run(tt.desc, func(t *testing.T) {
+			tlsConfig := tt.tlsConfig
+			if tlsConfig != nil {
+				// files are relative to the temporary directory
+				copied := *tlsConfig
+				for _, file := range []*string{&copied.CAFile, &copied.CertFile, &copied.KeyFile} {
+					if *file != "" {
+						*file = filepath.Join(dir, *file)
+					}
+				}
+				tlsConfig = &copied
+			}
+			kibana := &config.KibanaConfig{
+				Name:      "default",
+				TLSConfig: tlsConfig,
+			}
+			if err := kibana.SetDefault(server.URL, tt.skip, false); err != nil {
+				t.Fatalf("SetDefault failed with valid input: %s", err)
+			}
+			collector, err := NewCollector(kibana, nil)
+			if err != nil {
+				t.Fatalf("NewCollector failed with valid input: %s", err)
+			}
+			_, err = collector.scrape(context.Background())
+			if tt.valid && err != nil {
+				t.Errorf("scrape failed: %s", err)
+			}
+			if !tt.valid && err == nil {
+				t.Errorf("scrape should have failed")
+			}
+		})
+	}
+}
+
+func TestBasePathAndHeaders(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+		if r.URL.Path != "/kibana/api/status" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"status":{"overall":{"level":"available"}}}`)) // nolint: errcheck
+	}))
+	defer server.Close()
+
+	kibana := &config.KibanaConfig{
+		Name: "default",
+		Headers: map[string]string{
+			"X-Tenant": "ops",
+			"Host":     "kibana.corp",
+		},
+	}
+	collector := newKibanaCollector(t, kibana, server.URL+"/kibana/")
+	if _, err := collector.scrape(context.Background()); err != nil {
+		t.Fatalf("scrape failed: %s", err)
+	}
+	r := <-requests
+	if r.Header.Get("X-Tenant") != "ops" {
+		t.Errorf("expected X-Tenant header ops, got %q", r.Header.Get("X-Tenant"))
+	}
+	if r.Host != "kibana.corp" {
+		t.Errorf("expected Host kibana.corp, got %q", r.Host)
+	}
+}
+
+// proxy tests: the stand-in proxy answers for kibana.test itself, which can't
+// be reached without it.
+var proxyTests = []struct {
+	desc, noProxy string
+	proxied       bool
+}{
+	{
+		desc:    "through proxy",
+		proxied: true,
+	},
+	{
+		desc:    "domain in no_proxy",
+		noProxy: "localhost, .test",
+		proxied: false,
+	},
+}
+
+func TestProxy(t *testing.T) {
+	proxied := make(chan string, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied <- r.URL.String()
+		w.Write([]byte(`{"status":{"overall":{"level":"available"}}}`)) // nolint: errcheck
+	}))
+	defer proxy.Close()
+
+	for _, pt := range proxyTests {
+		t.Run(pt.desc, func(t *testing.T) {
+			kibana := &config.KibanaConfig{
+				Name:     "default",
+				ProxyURL: proxy.URL,
+				NoProxy:  pt.noProxy,
+				Timeout:  "2s",
+			}
+			collector := newKibanaCollector(t, kibana, "http://kibana.test:5601")
+			_, err := collector.scrape(context.Background())
+			if pt.proxied {
+				if err != nil {
+					t.Fatalf("scrape through proxy failed: %s", err)
+				}
+				if uri := <-proxied; uri != "http://kibana.test:5601/api/status" {
+					t.Errorf("expected proxied request for http://kibana.test:5601/api/status, got %s", uri)
+				}
+			} else {
+				if err == nil {
+					t.Errorf("scrape without proxy should have failed")
+				}
+				select {
+				case uri := <-proxied:
+					t.Errorf("request for %s should not use the proxy", uri)
+				default:
+				}
+			}
+		})
+	}
+}
+
+func TestProbeAll(t *testing.T) {
+	good := newStatusServer(t, "status_v8.json", nil)
+	defer good.Close()
+	unauthorized := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	}))
+	defer unauthorized.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	targets := make([]*KibanaCollector, 0)
+	for _, target := range []struct{ name, uri string }{
+		{"good", good.URL},
+		{"unauthorized", unauthorized.URL},
+		{"down", down.URL},
+	} {
+		kibana := &config.KibanaConfig{Name: target.name}
+		collector := newKibanaCollector(t, kibana, target.uri)
+		targets = append(targets, collector)
+	}
+
+	results := ProbeAll(context.Background(), targets)
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(results))
+	}
+	for index, expected := range []ProbeResult{
+		{Name: "good", Url: good.URL, Reachable: true, HttpStatus: 200, Version: "8.1.0", Status: "available"},
+		{Name: "unauthorized", Url: unauthorized.URL, Reachable: true, HttpStatus: 401},
+		{Name: "down", Url: down.URL},
+	} {
+		result := results[index]
+		if result.Name != expected.Name || result.Url != expected.Url || result.Reachable != expected.Reachable ||
+			result.HttpStatus != expected.HttpStatus || result.Version != expected.Version || result.Status != expected.Status {
+			t.Errorf("expected %+v, got %+v", expected, result)
+		}
+		if result.Failed() != (expected.Status == "") {
+			t.Errorf("%s: unexpected failure: %s", result.Name, result.Error)
+		}
+	}
+}
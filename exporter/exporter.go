@@ -1,154 +1,319 @@
 package exporter
 
 import (
+	"container/list"
+	"context"
 	"encoding/json"
 	"fmt"
-	"strings"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
+	"github.com/peekjef72/kibana-prometheus-exporter/config"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
 )
 
-// Exporter implements the prometheus.Collector interface. This will
-// be used to register the metrics with Prometheus.
+// Exporter holds the targets and the descriptions of the metrics shared by
+// all the scrapes. Only the collectors of the targets scraped by URL are added
+// once built, under a lock, so a TargetCollector can be registered for each
+// request and the targets scraped in parallel.
+// Metrics are built from the response of the current scrape each time
+// Collect() is called, so nothing is kept between scrapes or targets.
 type Exporter struct {
 	logger     log.Logger
-	lock       sync.RWMutex
 	Collectors []*KibanaCollector
-	target     *KibanaCollector
 	debug      bool
+	// export the kibana_status gauge besides kibana_status_level
+	legacyStatus bool
+	// name of the label holding the name of the target, none if empty
+	targetLabel string
 
 	KibanaByName map[string]*KibanaCollector
 
-	// metrics
-	status                prometheus.Gauge
-	info                  *prometheus.GaugeVec
-	concurrentConnections prometheus.Gauge
-	uptime                prometheus.Gauge
-	heapTotal             prometheus.Gauge
-	heapUsed              prometheus.Gauge
-	load1m                prometheus.Gauge
-	load5m                prometheus.Gauge
-	load15m               prometheus.Gauge
-	respTimeAvg           prometheus.Gauge
-	respTimeMax           prometheus.Gauge
-	reqDisconnects        prometheus.Gauge
-	reqTotal              prometheus.Gauge
+	// modules and allowlist of the targets scraped by URL; none if not set
+	Config *config.KibanaConfigs
+	// collectors of the targets scraped by URL by module and URL, kept to
+	// reuse connections and count scrape errors; the least recently used
+	// are dropped above maxURLTargets
+	urlTargets     map[string]*list.Element
+	urlTargetsLRU  *list.List
+	urlTargetsLock sync.Mutex
+	maxURLTargets  int
+
+	// metrics descriptions
+	up                    *prometheus.Desc
+	scrapeDuration        *prometheus.Desc
+	scrapeErrors          *prometheus.Desc
+	status                *prometheus.Desc
+	statusLevel           *prometheus.Desc
+	info                  *prometheus.Desc
+	serviceStatus         *prometheus.Desc
+	concurrentConnections *prometheus.Desc
+	uptime                *prometheus.Desc
+	heapTotal             *prometheus.Desc
+	heapUsed              *prometheus.Desc
+	heapSizeLimit         *prometheus.Desc
+	residentSetSize       *prometheus.Desc
+	eventLoopDelay        *prometheus.Desc
+	eventLoopDelayHist    *prometheus.Desc
+	eventLoopDelayMin     *prometheus.Desc
+	eventLoopDelayMax     *prometheus.Desc
+	eventLoopDelayMean    *prometheus.Desc
+	eventLoopDelayStddev  *prometheus.Desc
+	eventLoopUtilization  *prometheus.Desc
+	eventLoopActive       *prometheus.Desc
+	eventLoopIdle         *prometheus.Desc
+	load1m                *prometheus.Desc
+	load5m                *prometheus.Desc
+	load15m               *prometheus.Desc
+	osInfo                *prometheus.Desc
+	osUptime              *prometheus.Desc
+	osMemoryTotal         *prometheus.Desc
+	osMemoryFree          *prometheus.Desc
+	osMemoryUsed          *prometheus.Desc
+	cgroupCpuUsage        *prometheus.Desc
+	cgroupCfsPeriod       *prometheus.Desc
+	cgroupCfsQuota        *prometheus.Desc
+	cgroupElapsedPeriods  *prometheus.Desc
+	cgroupThrottled       *prometheus.Desc
+	cgroupThrottledTime   *prometheus.Desc
+	cgroupMemory          *prometheus.Desc
+	cgroupMemorySwap      *prometheus.Desc
+	respTimeAvg           *prometheus.Desc
+	respTimeMax           *prometheus.Desc
+	reqDisconnects        *prometheus.Desc
+	reqTotal              *prometheus.Desc
+
+	// optional collectors
+	collectorUp       *prometheus.Desc
+	collectorDuration *prometheus.Desc
+	taskManager       *taskManagerDescs
+	alerting          *alertingDescs
+	stats             *statsDescs
+}
+
+// optionalCollectors scrape the endpoint of an optional collector of a target
+// and send its metrics, by name of collector.
+var optionalCollectors = map[string]func(e *Exporter, ctx context.Context, target *KibanaCollector, ch chan<- prometheus.Metric) error{
+	config.CollectorTaskManager: (*Exporter).collectTaskManager,
+	config.CollectorAlerting:    (*Exporter).collectAlerting,
+	config.CollectorStats:       (*Exporter).collectStats,
 }
 
-var InfosLabels = []string{"version", "build"}
+// MaxURLTargets is the count of collectors of targets scraped by URL kept
+// between scrapes.
+const MaxURLTargets = 100
+
+// urlTarget is the collector of a target scraped by URL, kept in urlTargetsLRU.
+type urlTarget struct {
+	key       string
+	collector *KibanaCollector
+}
 
 // NewExporter will create a Exporter struct and initialize the metrics
 // that will be scraped by Prometheus. It will use the provided Kibana
 // details to populate a KibanaCollector struct.
-func NewExporter(namespace string, collectors []*KibanaCollector, debug bool, logger log.Logger) (*Exporter, error) {
+// legacyStatus enables the kibana_status gauge (1: green/available, 0: otherwise)
+// kept for backwards compatibility with the kibana_status_level state set.
+// targetLabel is the name of the label holding the name of the target added
+// to all its metrics, none if empty.
+func NewExporter(namespace string, collectors []*KibanaCollector, debug bool, legacyStatus bool, targetLabel string, logger log.Logger) (*Exporter, error) {
+	if namespace == "" {
+		return nil, fmt.Errorf("namespace must not be empty")
+	}
+	if targetLabel != "" && !model.LabelName(targetLabel).IsValid() {
+		return nil, fmt.Errorf("invalid target label name %s", targetLabel)
+	}
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
 
 	exporter := &Exporter{
-		logger:     logger,
-		Collectors: collectors,
-		debug:      debug,
-
-		// up: prometheus.NewGauge(
-		// 	prometheus.GaugeOpts{
-		// 		Name:      "up",
-		// 		Help:      "Kibana acces is OK (0: down, 1:up)",
-		// 		Namespace: namespace,
-		// 	}),
-		status: prometheus.NewGauge(
-			prometheus.GaugeOpts{
-				Name:      "status",
-				Help:      "Kibana overall status (0: down, 1:up)",
-				Namespace: namespace,
-			}),
-		info: prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Name:      "info",
-				Help:      "Kibana overall info, version build; see labels, always 1",
-				Namespace: namespace,
-			}, InfosLabels),
-		concurrentConnections: prometheus.NewGauge(
-			prometheus.GaugeOpts{
-				Name:      "concurrent_connections",
-				Namespace: namespace,
-				Help:      "Kibana Concurrent Connections",
-			}),
-		uptime: prometheus.NewGauge(
-			prometheus.GaugeOpts{
-				Name:      "millis_uptime",
-				Namespace: namespace,
-				Help:      "Kibana uptime in milliseconds",
-			}),
-		heapTotal: prometheus.NewGauge(
-			prometheus.GaugeOpts{
-				Name:      "heap_max_in_bytes",
-				Namespace: namespace,
-				Help:      "Kibana Heap maximum in bytes",
-			}),
-		heapUsed: prometheus.NewGauge(
-			prometheus.GaugeOpts{
-				Name:      "heap_used_in_bytes",
-				Namespace: namespace,
-				Help:      "Kibana Heap usage in bytes",
-			}),
-		load1m: prometheus.NewGauge(
-			prometheus.GaugeOpts{
-				Name:      "os_load_1m",
-				Namespace: namespace,
-				Help:      "Kibana load average 1m",
-			}),
-		load5m: prometheus.NewGauge(
-			prometheus.GaugeOpts{
-				Name:      "os_load_5m",
-				Namespace: namespace,
-				Help:      "Kibana load average 5m",
-			}),
-		load15m: prometheus.NewGauge(
-			prometheus.GaugeOpts{
-				Name:      "os_load_15m",
-				Namespace: namespace,
-				Help:      "Kibana load average 15m",
-			}),
-		respTimeAvg: prometheus.NewGauge(
-			prometheus.GaugeOpts{
-				Name:      "response_average",
-				Namespace: namespace,
-				Help:      "Kibana average response time in milliseconds",
-			}),
-		respTimeMax: prometheus.NewGauge(
-			prometheus.GaugeOpts{
-				Name:      "response_max",
-				Namespace: namespace,
-				Help:      "Kibana maximum response time in milliseconds",
-			}),
-		reqDisconnects: prometheus.NewGauge(
-			prometheus.GaugeOpts{
-				Name:      "requests_disconnects",
-				Namespace: namespace,
-				Help:      "Kibana request disconnections count",
-			}),
-		reqTotal: prometheus.NewGauge(
-			prometheus.GaugeOpts{
-				Name:      "requests_total",
-				Namespace: namespace,
-				Help:      "Kibana total request count",
-			}),
+		logger:       logger,
+		Collectors:   collectors,
+		debug:        debug,
+		legacyStatus: legacyStatus,
+		targetLabel:  targetLabel,
+
+		up: newDesc(namespace, "up",
+			"Kibana api/status could be scraped (0: down, 1:up)", nil),
+		scrapeDuration: newDesc(namespace, "scrape_duration_seconds",
+			"Duration of the last scrape of Kibana api/status in seconds", nil),
+		scrapeErrors: newDesc(namespace, "scrape_errors_total",
+			"Kibana scrape errors count by reason (connect, http_status, decode, credentials)", config.ScrapeErrorsLabels),
+		status: newDesc(namespace, "status",
+			"Kibana overall status (0: down, 1:up)", nil),
+		statusLevel: newDesc(namespace, "status_level",
+			"Kibana overall status as a state set: 1 for the current level, 0 for the others", config.StatusLevelLabels),
+		info: newDesc(namespace, "info",
+			"Kibana overall info, version build; see labels, always 1", config.InfosLabels),
+		serviceStatus: newDesc(namespace, "service_status",
+			"Kibana core service or plugin status (0: not green/available, 1: green/available); see level label", config.ServiceStatusLabels),
+		concurrentConnections: newDesc(namespace, "concurrent_connections",
+			"Kibana Concurrent Connections", nil),
+		uptime: newDesc(namespace, "millis_uptime",
+			"Kibana uptime in milliseconds", nil),
+		heapTotal: newDesc(namespace, "heap_max_in_bytes",
+			"Kibana Heap maximum in bytes", nil),
+		heapUsed: newDesc(namespace, "heap_used_in_bytes",
+			"Kibana Heap usage in bytes", nil),
+		heapSizeLimit: newDesc(namespace, "heap_size_limit_in_bytes",
+			"Kibana Heap size limit in bytes", nil),
+		residentSetSize: newDesc(namespace, "resident_set_size_in_bytes",
+			"Kibana process resident set size in bytes", nil),
+		eventLoopDelay: newDesc(namespace, "event_loop_delay_milliseconds",
+			"Kibana event loop delay in milliseconds", nil),
+		eventLoopDelayHist: newDesc(namespace, "event_loop_delay_histogram_milliseconds",
+			"Kibana event loop delay percentiles in milliseconds over the last collection interval; sum and count are not provided", nil),
+		eventLoopDelayMin: newDesc(namespace, "event_loop_delay_min_milliseconds",
+			"Kibana minimum event loop delay in milliseconds over the last collection interval", nil),
+		eventLoopDelayMax: newDesc(namespace, "event_loop_delay_max_milliseconds",
+			"Kibana maximum event loop delay in milliseconds over the last collection interval", nil),
+		eventLoopDelayMean: newDesc(namespace, "event_loop_delay_mean_milliseconds",
+			"Kibana mean event loop delay in milliseconds over the last collection interval", nil),
+		eventLoopDelayStddev: newDesc(namespace, "event_loop_delay_stddev_milliseconds",
+			"Kibana standard deviation of the event loop delay in milliseconds over the last collection interval", nil),
+		eventLoopUtilization: newDesc(namespace, "event_loop_utilization_ratio",
+			"Kibana event loop utilization (active time / elapsed time) over the last collection interval", nil),
+		eventLoopActive: newDesc(namespace, "event_loop_active_milliseconds",
+			"Kibana event loop active time in milliseconds over the last collection interval", nil),
+		eventLoopIdle: newDesc(namespace, "event_loop_idle_milliseconds",
+			"Kibana event loop idle time in milliseconds over the last collection interval", nil),
+		load1m: newDesc(namespace, "os_load_1m",
+			"Kibana load average 1m", nil),
+		load5m: newDesc(namespace, "os_load_5m",
+			"Kibana load average 5m", nil),
+		load15m: newDesc(namespace, "os_load_15m",
+			"Kibana load average 15m", nil),
+		osInfo: newDesc(namespace, "os_info",
+			"Kibana host operating system, platform and release; see labels, always 1", config.OsInfoLabels),
+		osUptime: newDesc(namespace, "os_millis_uptime",
+			"Kibana host uptime in milliseconds", nil),
+		osMemoryTotal: newDesc(namespace, "os_memory_total_in_bytes",
+			"Kibana host total memory in bytes", nil),
+		osMemoryFree: newDesc(namespace, "os_memory_free_in_bytes",
+			"Kibana host free memory in bytes", nil),
+		osMemoryUsed: newDesc(namespace, "os_memory_used_in_bytes",
+			"Kibana host used memory in bytes", nil),
+		cgroupCpuUsage: newDesc(namespace, "os_cgroup_cpuacct_usage_nanos_total",
+			"Kibana cgroup CPU time used by the tasks in nanoseconds", nil),
+		cgroupCfsPeriod: newDesc(namespace, "os_cgroup_cpu_cfs_period_micros",
+			"Kibana cgroup CFS period in microseconds", nil),
+		cgroupCfsQuota: newDesc(namespace, "os_cgroup_cpu_cfs_quota_micros",
+			"Kibana cgroup CFS quota in microseconds for each period, -1 if not limited", nil),
+		cgroupElapsedPeriods: newDesc(namespace, "os_cgroup_cpu_elapsed_periods_total",
+			"Kibana cgroup count of elapsed CFS periods", nil),
+		cgroupThrottled: newDesc(namespace, "os_cgroup_cpu_throttled_periods_total",
+			"Kibana cgroup count of CFS periods the tasks were throttled", nil),
+		cgroupThrottledTime: newDesc(namespace, "os_cgroup_cpu_throttled_nanos_total",
+			"Kibana cgroup time the tasks were throttled in nanoseconds", nil),
+		cgroupMemory: newDesc(namespace, "os_cgroup_memory_current_in_bytes",
+			"Kibana cgroup memory usage in bytes", nil),
+		cgroupMemorySwap: newDesc(namespace, "os_cgroup_memory_swap_current_in_bytes",
+			"Kibana cgroup swap usage in bytes", nil),
+		respTimeAvg: newDesc(namespace, "response_average",
+			"Kibana average response time in milliseconds", nil),
+		respTimeMax: newDesc(namespace, "response_max",
+			"Kibana maximum response time in milliseconds", nil),
+		reqDisconnects: newDesc(namespace, "requests_disconnects",
+			"Kibana request disconnections count", nil),
+		reqTotal: newDesc(namespace, "requests_total",
+			"Kibana total request count", nil),
+
+		collectorUp: newDesc(namespace, "collector_up",
+			"Kibana endpoint of the optional collector could be scraped (0: down, 1:up)", config.CollectorLabels),
+		collectorDuration: newDesc(namespace, "collector_duration_seconds",
+			"Duration of the last scrape of the endpoint of the optional collector in seconds", config.CollectorLabels),
+		taskManager: newTaskManagerDescs(namespace),
+		alerting:    newAlertingDescs(namespace),
+		stats:       newStatsDescs(namespace),
 	}
 	// initialize the map
 	exporter.KibanaByName = make(map[string]*KibanaCollector)
+	exporter.urlTargets = make(map[string]*list.Element)
+	exporter.urlTargetsLRU = list.New()
+	exporter.maxURLTargets = MaxURLTargets
 	// build the map with the name of each kibana's name
 	for _, coll := range exporter.Collectors {
+		if _, ok := exporter.KibanaByName[coll.kibana.Name]; ok {
+			return nil, fmt.Errorf("duplicate target name %s", coll.kibana.Name)
+		}
 		exporter.KibanaByName[coll.kibana.Name] = coll
+		if err := exporter.checkLabels(coll); err != nil {
+			return nil, err
+		}
 	}
 
 	return exporter, nil
 }
 
+// newDesc builds the description of a metric of the exporter.
+func newDesc(namespace, name, help string, labels []string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(namespace, "", name), help, labels, nil)
+}
+
 //*************************************************************************************************
-//
-func (e *Exporter) SetTarget(target *KibanaCollector) error {
-	e.target = target
+
+// TargetCollector implements the prometheus.Collector interface for one target
+// of the Exporter. This will be used to register the metrics with Prometheus:
+// one is built for each request, so concurrent scrapes don't share any state.
+type TargetCollector struct {
+	exporter *Exporter
+	target   *KibanaCollector
+	// scrapes are canceled when ctx is done (request canceled or scrape timeout)
+	ctx context.Context
+}
+
+// NewTargetCollector builds the prometheus.Collector scraping the target.
+func (e *Exporter) NewTargetCollector(ctx context.Context, target *KibanaCollector) *TargetCollector {
+	return &TargetCollector{
+		exporter: e,
+		target:   target,
+		ctx:      ctx,
+	}
+}
+
+// Describe is the TargetCollector implementing prometheus.Collector
+func (t *TargetCollector) Describe(ch chan<- *prometheus.Desc) {
+	t.exporter.describe(t.target, ch)
+}
+
+// Collect is the TargetCollector implementing prometheus.Collector
+func (t *TargetCollector) Collect(ch chan<- prometheus.Metric) {
+	t.exporter.collect(t.ctx, t.target, ch)
+}
+
+// TargetLabels returns the labels added to all the metrics of the target:
+// its static labels, and its name when the target label is set.
+func (e *Exporter) TargetLabels(target *KibanaCollector) prometheus.Labels {
+	labels := make(prometheus.Labels, len(target.kibana.Labels)+1)
+	for name, val := range target.kibana.Labels {
+		labels[name] = val
+	}
+	if e.targetLabel != "" {
+		labels[e.targetLabel] = target.kibana.Name
+	}
+	return labels
+}
+
+// Register registers the TargetCollector of the target with its labels.
+func (e *Exporter) Register(reg prometheus.Registerer, ctx context.Context, target *KibanaCollector) error {
+	return prometheus.WrapRegistererWith(e.TargetLabels(target), reg).Register(e.NewTargetCollector(ctx, target))
+}
+
+// checkLabels checks that the labels of the target don't clash with the
+// labels of the metrics.
+func (e *Exporter) checkLabels(target *KibanaCollector) error {
+	if _, ok := target.kibana.Labels[e.targetLabel]; ok && e.targetLabel != "" {
+		return fmt.Errorf("invalid labels for %s: %s is the target label", target.kibana.Name, e.targetLabel)
+	}
+	// only Describe() is called
+	if err := e.Register(prometheus.NewRegistry(), context.Background(), target); err != nil {
+		return fmt.Errorf("invalid labels for %s: %s", target.kibana.Name, err)
+	}
 	return nil
 }
 
@@ -161,128 +326,341 @@ func (e *Exporter) FindTarget(target string) *KibanaCollector {
 	return e.KibanaByName[target]
 }
 
+// FindURLTarget returns the collector of a target scraped by URL with the
+// settings of module, built on first use. The URL must be allowed by the
+// target_allowlist of the config.
+// The collectors are kept by module and normalized URL; the least recently
+// used one is dropped, with its scrape errors counts, when more than
+// MaxURLTargets are kept.
+func (e *Exporter) FindURLTarget(target string, module string) (*KibanaCollector, error) {
+	if e.Config == nil {
+		return nil, fmt.Errorf("targets can't be scraped by URL: no config file")
+	}
+	if module == "" {
+		module = "default"
+	}
+	kibana, err := e.Config.TargetConfig(target, module)
+	if err != nil {
+		return nil, err
+	}
+	key := module + " " + kibana.Url()
+
+	e.urlTargetsLock.Lock()
+	defer e.urlTargetsLock.Unlock()
+	if elem, ok := e.urlTargets[key]; ok {
+		e.urlTargetsLRU.MoveToFront(elem)
+		return elem.Value.(*urlTarget).collector, nil
+	}
+	coll, err := NewCollector(kibana, e.logger)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.checkLabels(coll); err != nil {
+		return nil, err
+	}
+	e.urlTargets[key] = e.urlTargetsLRU.PushFront(&urlTarget{key: key, collector: coll})
+	for e.urlTargetsLRU.Len() > e.maxURLTargets {
+		oldest := e.urlTargetsLRU.Remove(e.urlTargetsLRU.Back()).(*urlTarget)
+		delete(e.urlTargets, oldest.key)
+		// scrapes in progress still use it
+		oldest.collector.closeIdleConnections()
+	}
+	return coll, nil
+}
+
+// CloseIdleConnections closes the connections to Kibana kept by the
+// collectors of the targets, when the exporter is replaced by a reload;
+// scrapes in progress still use them.
+func (e *Exporter) CloseIdleConnections() {
+	for _, coll := range e.Collectors {
+		coll.closeIdleConnections()
+	}
+	e.urlTargetsLock.Lock()
+	defer e.urlTargetsLock.Unlock()
+	for _, elem := range e.urlTargets {
+		elem.Value.(*urlTarget).collector.closeIdleConnections()
+	}
+}
+
 //*************************************************************************************************
 
-// parseMetrics will set the metrics values using the KibanaMetrics
-// struct, converting values to float64 where needed.
-func (e *Exporter) parseMetrics(m *KibanaMetrics) error {
+// gauge sends a gauge built from a value received in the current scrape.
+func gauge(ch chan<- prometheus.Metric, desc *prometheus.Desc, value float64, labels ...string) {
+	ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, labels...)
+}
+
+// counter sends a counter built from a cumulative value received in the
+// current scrape.
+func counter(ch chan<- prometheus.Metric, desc *prometheus.Desc, value float64, labels ...string) {
+	ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, value, labels...)
+}
+
+// parseMetrics will send the metrics built from the KibanaMetrics
+// struct of the current scrape, converting values to float64 where needed.
+func (e *Exporter) parseMetrics(m *KibanaMetrics, ch chan<- prometheus.Metric) error {
 	level.Debug(e.logger).
 		Log("msg", "parsing received metrics from kibana")
 
-	// any value other than "green" is assumed to be less than 1
+	// any value other than "green" (v7) or "available" (v8) is assumed to be less than 1
 	statusVal := 0.0
-	if strings.ToLower(m.Status.Overall.State) == "green" {
+	if m.IsAvailable() {
 		statusVal = 1.0
 	}
+	if e.legacyStatus {
+		gauge(ch, e.status, statusVal)
+	}
 
-	e.status.Set(statusVal)
-	if statusVal == 1.0 {
-		// info is always 1; labels may change
-		labels := make([]string, len(InfosLabels))
-		labels[0] = m.VersionPart.Version
-		labels[1] = fmt.Sprintf("%d", m.VersionPart.Build)
-		e.info.WithLabelValues(labels[:]...).Set(1.0)
+	// state set: every level known for the format, only the current one is 1
+	current := m.OverallStatus()
+	known := false
+	for _, lvl := range StatusLevels[m.StatusFormat()] {
+		levelVal := 0.0
+		if lvl == current {
+			levelVal = 1.0
+			known = true
+		}
+		gauge(ch, e.statusLevel, levelVal, lvl)
+	}
+	if !known && current != "" {
+		// a level unknown to the exporter must not be lost
+		gauge(ch, e.statusLevel, 1.0, current)
+	}
 
-		e.concurrentConnections.Set(float64(m.Metrics.ConcurrentConnections))
-		e.uptime.Set(float64(m.Metrics.Process.UptimeInMillis))
-		e.heapTotal.Set(float64(m.Metrics.Process.Memory.Heap.TotalInBytes))
-		e.heapUsed.Set(float64(m.Metrics.Process.Memory.Heap.UsedInBytes))
-		e.load1m.Set(m.Metrics.Os.Load.Load1m)
-		e.load5m.Set(m.Metrics.Os.Load.Load5m)
-		e.load15m.Set(m.Metrics.Os.Load.Load15m)
-		e.respTimeAvg.Set(m.Metrics.ResponseTimes.AvgInMillis)
-		e.respTimeMax.Set(m.Metrics.ResponseTimes.MaxInMillis)
-		e.reqDisconnects.Set(float64(m.Metrics.Requests.Disconnects))
-		e.reqTotal.Set(float64(m.Metrics.Requests.Total))
+	for _, service := range m.Services() {
+		serviceVal := 0.0
+		if isAvailableStatus(service.Level) {
+			serviceVal = 1.0
+		}
+		gauge(ch, e.serviceStatus, serviceVal, service.Name, service.Kind, service.Level)
 	}
 
-	return nil
-}
+	gauge(ch, e.concurrentConnections, float64(m.Metrics.ConcurrentConnections))
+	gauge(ch, e.uptime, m.Metrics.Process.UptimeInMillis)
+	gauge(ch, e.heapTotal, float64(m.Metrics.Process.Memory.Heap.TotalInBytes))
+	gauge(ch, e.heapUsed, float64(m.Metrics.Process.Memory.Heap.UsedInBytes))
+	gauge(ch, e.heapSizeLimit, float64(m.Metrics.Process.Memory.Heap.SizeLimit))
+	gauge(ch, e.residentSetSize, float64(m.Metrics.Process.Memory.ResidentSetSizeInBytes))
 
-func (e *Exporter) send(ch chan<- prometheus.Metric) error {
-	ch <- e.status
-	if e.target.State {
-		e.info.Collect(ch)
-		ch <- e.concurrentConnections
-		ch <- e.uptime
-		ch <- e.heapTotal
-		ch <- e.heapUsed
-		ch <- e.load1m
-		ch <- e.load5m
-		ch <- e.load15m
-		ch <- e.respTimeAvg
-		ch <- e.respTimeMax
-		ch <- e.reqDisconnects
-		ch <- e.reqTotal
+	// event loop metrics depend on the version of Kibana
+	process := &m.Metrics.Process
+	if process.EventLoopDelay != nil {
+		gauge(ch, e.eventLoopDelay, *process.EventLoopDelay)
 	}
+	if hist := process.EventLoopDelayHistogram; hist != nil {
+		// Kibana sends no sum nor count: they are left to 0
+		quantiles := make(map[float64]float64, len(hist.Percentiles))
+		for percentile, value := range hist.Percentiles {
+			if p, err := strconv.ParseFloat(percentile, 64); err == nil {
+				quantiles[p/100] = value
+			}
+		}
+		ch <- prometheus.MustNewConstSummary(e.eventLoopDelayHist, 0, 0, quantiles)
+		gauge(ch, e.eventLoopDelayMin, hist.Min)
+		gauge(ch, e.eventLoopDelayMax, hist.Max)
+		gauge(ch, e.eventLoopDelayMean, hist.Mean)
+		gauge(ch, e.eventLoopDelayStddev, hist.Stddev)
+	}
+	if elu := process.EventLoopUtilization; elu != nil {
+		gauge(ch, e.eventLoopUtilization, elu.Utilization)
+		gauge(ch, e.eventLoopActive, elu.Active)
+		gauge(ch, e.eventLoopIdle, elu.Idle)
+	}
+
+	gauge(ch, e.load1m, m.Metrics.Os.Load.Load1m)
+	gauge(ch, e.load5m, m.Metrics.Os.Load.Load5m)
+	gauge(ch, e.load15m, m.Metrics.Os.Load.Load15m)
+
+	host := &m.Metrics.Os
+	if host.Platform != "" {
+		gauge(ch, e.osInfo, 1.0, host.Platform, host.PlatformRelease)
+	}
+	gauge(ch, e.osUptime, host.UptimeInMillis)
+	gauge(ch, e.osMemoryTotal, float64(host.Memory.TotalInBytes))
+	gauge(ch, e.osMemoryFree, float64(host.Memory.FreeInBytes))
+	gauge(ch, e.osMemoryUsed, float64(host.Memory.UsedInBytes))
+	// cgroup stats are only sent by Kibana running in a container
+	if host.Cpuacct != nil {
+		counter(ch, e.cgroupCpuUsage, host.Cpuacct.UsageNanos)
+	}
+	if cpu := host.Cpu; cpu != nil {
+		gauge(ch, e.cgroupCfsPeriod, cpu.CfsPeriodMicros)
+		gauge(ch, e.cgroupCfsQuota, cpu.CfsQuotaMicros)
+		counter(ch, e.cgroupElapsedPeriods, cpu.Stat.NumberOfElapsedPeriods)
+		counter(ch, e.cgroupThrottled, cpu.Stat.NumberOfTimesThrottled)
+		counter(ch, e.cgroupThrottledTime, cpu.Stat.TimeThrottledNanos)
+	}
+	if memory := host.CgroupMemory; memory != nil {
+		gauge(ch, e.cgroupMemory, memory.CurrentInBytes)
+		if memory.SwapCurrentInBytes != nil {
+			gauge(ch, e.cgroupMemorySwap, *memory.SwapCurrentInBytes)
+		}
+	}
+	gauge(ch, e.respTimeAvg, m.Metrics.ResponseTimes.AvgInMillis)
+	gauge(ch, e.respTimeMax, m.Metrics.ResponseTimes.MaxInMillis)
+	gauge(ch, e.reqDisconnects, float64(m.Metrics.Requests.Disconnects))
+	gauge(ch, e.reqTotal, float64(m.Metrics.Requests.Total))
+
 	return nil
 }
 
-// Describe is the Exporter implementing prometheus.Collector
-func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
-	ch <- e.status.Desc()
-	e.info.Describe(ch)
-	ch <- e.concurrentConnections.Desc()
-	ch <- e.uptime.Desc()
-	ch <- e.heapTotal.Desc()
-	ch <- e.heapUsed.Desc()
-	ch <- e.load1m.Desc()
-	ch <- e.load5m.Desc()
-	ch <- e.load15m.Desc()
-	ch <- e.respTimeAvg.Desc()
-	ch <- e.respTimeMax.Desc()
-	ch <- e.reqDisconnects.Desc()
-	ch <- e.reqTotal.Desc()
+// describe sends the descriptions of the metrics of the target: all the
+// metrics of the exporter but the ones of the optional collectors not run for
+// the target, so their labels are only reserved when used.
+func (e *Exporter) describe(target *KibanaCollector, ch chan<- *prometheus.Desc) {
+	ch <- e.up
+	ch <- e.scrapeDuration
+	ch <- e.scrapeErrors
+	if e.legacyStatus {
+		ch <- e.status
+	}
+	ch <- e.statusLevel
+	if !target.runs(config.CollectorStats) {
+		// kibana_info with the identifiers otherwise
+		ch <- e.info
+	}
+	ch <- e.serviceStatus
+	ch <- e.concurrentConnections
+	ch <- e.uptime
+	ch <- e.heapTotal
+	ch <- e.heapUsed
+	ch <- e.heapSizeLimit
+	ch <- e.residentSetSize
+	ch <- e.eventLoopDelay
+	ch <- e.eventLoopDelayHist
+	ch <- e.eventLoopDelayMin
+	ch <- e.eventLoopDelayMax
+	ch <- e.eventLoopDelayMean
+	ch <- e.eventLoopDelayStddev
+	ch <- e.eventLoopUtilization
+	ch <- e.eventLoopActive
+	ch <- e.eventLoopIdle
+	ch <- e.load1m
+	ch <- e.load5m
+	ch <- e.load15m
+	ch <- e.osInfo
+	ch <- e.osUptime
+	ch <- e.osMemoryTotal
+	ch <- e.osMemoryFree
+	ch <- e.osMemoryUsed
+	ch <- e.cgroupCpuUsage
+	ch <- e.cgroupCfsPeriod
+	ch <- e.cgroupCfsQuota
+	ch <- e.cgroupElapsedPeriods
+	ch <- e.cgroupThrottled
+	ch <- e.cgroupThrottledTime
+	ch <- e.cgroupMemory
+	ch <- e.cgroupMemorySwap
+	ch <- e.respTimeAvg
+	ch <- e.respTimeMax
+	ch <- e.reqDisconnects
+	ch <- e.reqTotal
+
+	ch <- e.collectorUp
+	ch <- e.collectorDuration
+	for _, name := range target.kibana.Collectors {
+		switch name {
+		case config.CollectorTaskManager:
+			e.taskManager.describe(ch)
+		case config.CollectorAlerting:
+			e.alerting.describe(ch)
+		case config.CollectorStats:
+			e.stats.describe(ch)
+		}
+	}
 }
 
-// Collect is the Exporter implementing prometheus.Collector
-func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+// collect scrapes the target and sends the metrics built from its response.
+func (e *Exporter) collect(ctx context.Context, target *KibanaCollector, ch chan<- prometheus.Metric) {
 	level.Debug(e.logger).
 		Log("msg", "a Collect() call received")
 
-	e.lock.Lock()
-	defer e.lock.Unlock()
-
 	level.Debug(e.logger).
 		Log("msg", "issueing a scrape() call to the collector")
 
-	if e.target == nil {
+	if target == nil {
 		level.Error(e.logger).
 			Log("msg", "target not set: Can't scrape.")
 		return
 
 	}
-	metrics, err := e.target.scrape()
+	start := time.Now()
+	metrics, err := target.scrape(ctx)
+	gauge(ch, e.scrapeDuration, time.Since(start).Seconds())
+
+	// counters are kept by the collector of each target
+	for reason, count := range target.ScrapeErrors() {
+		ch <- prometheus.MustNewConstMetric(e.scrapeErrors, prometheus.CounterValue, count, reason)
+	}
+
 	if err != nil {
+		reason := ""
+		if serr, ok := err.(*ScrapeError); ok {
+			reason = serr.Reason
+		}
 		level.Error(e.logger).
-			Log("msg", fmt.Sprintf("error while scraping metrics from Kibana: %s", err))
-	}
-
-	if e.target.State {
-		// output for debugging
-		if e.debug {
-			res, err := json.Marshal(metrics)
-			if err != nil {
-				level.Error(e.logger).
-					Log("msg", fmt.Sprintf("error convert to json: %s", err))
-			} else {
-				level.Debug(e.logger).
-					Log("msg", "returned metrics content", "metrics", res)
-			}
+			Log("msg", fmt.Sprintf("error while scraping metrics from Kibana: %s", err), "reason", reason)
+		gauge(ch, e.up, 0.0)
+		if e.legacyStatus {
+			gauge(ch, e.status, 0.0)
 		}
+		return
+	}
+	gauge(ch, e.up, 1.0)
 
-		err = e.parseMetrics(metrics)
+	// output for debugging
+	if e.debug {
+		res, err := json.Marshal(metrics)
 		if err != nil {
 			level.Error(e.logger).
-				Log("msg", fmt.Sprintf("error while parsing metrics from Kibana: %s", err))
-			return
+				Log("msg", fmt.Sprintf("error convert to json: %s", err))
+		} else {
+			level.Debug(e.logger).
+				Log("msg", "returned metrics content", "metrics", res)
 		}
-	} else {
-		e.status.Set(0.0)
 	}
-	err = e.send(ch)
+
+	err = e.parseMetrics(metrics, ch)
 	if err != nil {
 		level.Error(e.logger).
-			Log("msg", fmt.Sprintf("error while responding to Prometheus with metrics: %s", err))
+			Log("msg", fmt.Sprintf("error while parsing metrics from Kibana: %s", err))
+	}
+
+	e.collectOptional(ctx, target, ch)
+	e.collectInfo(target, metrics, ch)
+}
+
+// collectInfo sends kibana_info, with the instance and cluster identifiers of
+// the last successful scrape of api/stats for the targets running the stats
+// collector: they are kept when a scrape of api/stats fails, so the series
+// doesn't change.
+func (e *Exporter) collectInfo(target *KibanaCollector, m *KibanaMetrics, ch chan<- prometheus.Metric) {
+	// info is always 1; labels may change
+	labels := []string{m.VersionPart.Version, fmt.Sprintf("%d", m.VersionPart.Build)}
+	if !target.runs(config.CollectorStats) {
+		gauge(ch, e.info, 1.0, labels...)
+		return
+	}
+	gauge(ch, e.stats.info, 1.0, append(labels, target.StatsIdentifiers()...)...)
+}
+
+// collectOptional runs the optional collectors of the target; a failed one
+// doesn't prevent the others from running.
+func (e *Exporter) collectOptional(ctx context.Context, target *KibanaCollector, ch chan<- prometheus.Metric) {
+	for _, name := range target.kibana.Collectors {
+		collect, ok := optionalCollectors[name]
+		if !ok {
+			// names are checked with the config
+			continue
+		}
+		start := time.Now()
+		err := collect(e, ctx, target, ch)
+		gauge(ch, e.collectorDuration, time.Since(start).Seconds(), name)
+		if err != nil {
+			level.Error(e.logger).
+				Log("msg", fmt.Sprintf("error while scraping %s metrics from Kibana: %s", name, err), "collector", name)
+			gauge(ch, e.collectorUp, 0.0, name)
+			continue
+		}
+		gauge(ch, e.collectorUp, 1.0, name)
 	}
 }
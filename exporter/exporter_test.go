@@ -1,14 +1,673 @@
 package exporter
 
 import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/peekjef72/kibana-prometheus-exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestNewExporterWithoutNamespace(t *testing.T) {
 	colls := make([]*KibanaCollector, 1)
 	colls = append(colls, &KibanaCollector{})
-	_, err := NewExporter("", colls, false, nil)
+	_, err := NewExporter("", colls, false, true, "", nil)
 	if err == nil {
 		t.Errorf("expected error when invalid namespace was provided")
 	}
 }
+
+func TestExporterServiceStatus(t *testing.T) {
+	target, stop := newTargetCollector(t, "status_v8.json")
+	defer stop()
+
+	expected := `
+# HELP kibana_service_status Kibana core service or plugin status (0: not green/available, 1: green/available); see level label
+# TYPE kibana_service_status gauge
+kibana_service_status{kind="core",level="available",service="elasticsearch"} 1
+kibana_service_status{kind="core",level="available",service="savedObjects"} 1
+kibana_service_status{kind="plugin",level="available",service="taskManager"} 1
+kibana_service_status{kind="plugin",level="degraded",service="alerting"} 0
+`
+	if err := testutil.CollectAndCompare(target, strings.NewReader(expected), "kibana_service_status"); err != nil {
+		t.Error(err)
+	}
+}
+
+// status level state set tests
+var statusLevelTests = []struct {
+	desc, fixture, expected string
+	legacyStatus            bool
+}{
+	{
+		desc:         "7.x legacy format",
+		fixture:      "status_v7.json",
+		legacyStatus: true,
+		expected: `
+# HELP kibana_status Kibana overall status (0: down, 1:up)
+# TYPE kibana_status gauge
+kibana_status 0
+# HELP kibana_status_level Kibana overall status as a state set: 1 for the current level, 0 for the others
+# TYPE kibana_status_level gauge
+kibana_status_level{level="green"} 0
+kibana_status_level{level="red"} 0
+kibana_status_level{level="yellow"} 1
+`,
+	},
+	{
+		desc:         "8.x format without legacy status",
+		fixture:      "status_v8.json",
+		legacyStatus: false,
+		expected: `
+# HELP kibana_status_level Kibana overall status as a state set: 1 for the current level, 0 for the others
+# TYPE kibana_status_level gauge
+kibana_status_level{level="available"} 1
+kibana_status_level{level="critical"} 0
+kibana_status_level{level="degraded"} 0
+kibana_status_level{level="unavailable"} 0
+`,
+	},
+}
+
+func TestExporterStatusLevel(t *testing.T) {
+	for _, st := range statusLevelTests {
+		t.Run(st.desc, func(t *testing.T) {
+			server := newStatusServer(t, st.fixture, nil)
+			defer server.Close()
+
+			target := newExporterTarget(t, server.URL, st.legacyStatus)
+
+			if err := testutil.CollectAndCompare(target, strings.NewReader(st.expected), "kibana_status", "kibana_status_level"); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// event loop tests
+var eventLoopTests = []struct {
+	desc, fixture, expected string
+}{
+	{
+		desc:    "7.x delay only",
+		fixture: "status_v7.json",
+		expected: `
+# HELP kibana_event_loop_delay_milliseconds Kibana event loop delay in milliseconds
+# TYPE kibana_event_loop_delay_milliseconds gauge
+kibana_event_loop_delay_milliseconds 10.414
+`,
+	},
+	{
+		desc:    "8.x histogram and utilization",
+		fixture: "status_v8.json",
+		expected: `
+# HELP kibana_event_loop_delay_milliseconds Kibana event loop delay in milliseconds
+# TYPE kibana_event_loop_delay_milliseconds gauge
+kibana_event_loop_delay_milliseconds 10.627
+# HELP kibana_event_loop_delay_histogram_milliseconds Kibana event loop delay percentiles in milliseconds over the last collection interval; sum and count are not provided
+# TYPE kibana_event_loop_delay_histogram_milliseconds summary
+kibana_event_loop_delay_histogram_milliseconds{quantile="0.5"} 10.13
+kibana_event_loop_delay_histogram_milliseconds{quantile="0.75"} 10.62
+kibana_event_loop_delay_histogram_milliseconds{quantile="0.95"} 11.94
+kibana_event_loop_delay_histogram_milliseconds{quantile="0.99"} 15.27
+kibana_event_loop_delay_histogram_milliseconds_sum 0
+kibana_event_loop_delay_histogram_milliseconds_count 0
+# HELP kibana_event_loop_delay_max_milliseconds Kibana maximum event loop delay in milliseconds over the last collection interval
+# TYPE kibana_event_loop_delay_max_milliseconds gauge
+kibana_event_loop_delay_max_milliseconds 72.35
+# HELP kibana_event_loop_utilization_ratio Kibana event loop utilization (active time / elapsed time) over the last collection interval
+# TYPE kibana_event_loop_utilization_ratio gauge
+kibana_event_loop_utilization_ratio 0.0567
+`,
+	},
+	{
+		// no event loop field: nothing exported
+		desc:     "no event loop metrics",
+		fixture:  "status_minimal.json",
+		expected: "",
+	},
+}
+
+func TestExporterEventLoop(t *testing.T) {
+	for _, et := range eventLoopTests {
+		t.Run(et.desc, func(t *testing.T) {
+			target, stop := newTargetCollector(t, et.fixture)
+			defer stop()
+
+			if err := testutil.CollectAndCompare(target, strings.NewReader(et.expected),
+				"kibana_event_loop_delay_milliseconds",
+				"kibana_event_loop_delay_histogram_milliseconds",
+				"kibana_event_loop_delay_max_milliseconds",
+				"kibana_event_loop_utilization_ratio",
+			); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// memory and cgroup tests
+var memoryTests = []struct {
+	desc, fixture, expected string
+}{
+	{
+		desc:    "7.x without cgroup",
+		fixture: "status_v7.json",
+		expected: `
+# HELP kibana_heap_size_limit_in_bytes Kibana Heap size limit in bytes
+# TYPE kibana_heap_size_limit_in_bytes gauge
+kibana_heap_size_limit_in_bytes 4.345298944e+09
+# HELP kibana_resident_set_size_in_bytes Kibana process resident set size in bytes
+# TYPE kibana_resident_set_size_in_bytes gauge
+kibana_resident_set_size_in_bytes 5.12385024e+08
+# HELP kibana_os_info Kibana host operating system, platform and release; see labels, always 1
+# TYPE kibana_os_info gauge
+kibana_os_info{platform="linux",platform_release="linux-5.10.0"} 1
+# HELP kibana_os_memory_free_in_bytes Kibana host free memory in bytes
+# TYPE kibana_os_memory_free_in_bytes gauge
+kibana_os_memory_free_in_bytes 2.470887424e+09
+# HELP kibana_os_millis_uptime Kibana host uptime in milliseconds
+# TYPE kibana_os_millis_uptime gauge
+kibana_os_millis_uptime 1.036254e+09
+`,
+	},
+	{
+		desc:    "8.x in a container",
+		fixture: "status_v8.json",
+		expected: `
+# HELP kibana_heap_size_limit_in_bytes Kibana Heap size limit in bytes
+# TYPE kibana_heap_size_limit_in_bytes gauge
+kibana_heap_size_limit_in_bytes 4.345298944e+09
+# HELP kibana_resident_set_size_in_bytes Kibana process resident set size in bytes
+# TYPE kibana_resident_set_size_in_bytes gauge
+kibana_resident_set_size_in_bytes 6.02198016e+08
+# HELP kibana_os_info Kibana host operating system, platform and release; see labels, always 1
+# TYPE kibana_os_info gauge
+kibana_os_info{platform="linux",platform_release="linux-5.10.0"} 1
+# HELP kibana_os_memory_free_in_bytes Kibana host free memory in bytes
+# TYPE kibana_os_memory_free_in_bytes gauge
+kibana_os_memory_free_in_bytes 1.235288064e+09
+# HELP kibana_os_millis_uptime Kibana host uptime in milliseconds
+# TYPE kibana_os_millis_uptime gauge
+kibana_os_millis_uptime 5.2354e+08
+# HELP kibana_os_cgroup_cpu_cfs_quota_micros Kibana cgroup CFS quota in microseconds for each period, -1 if not limited
+# TYPE kibana_os_cgroup_cpu_cfs_quota_micros gauge
+kibana_os_cgroup_cpu_cfs_quota_micros 200000
+# HELP kibana_os_cgroup_cpuacct_usage_nanos_total Kibana cgroup CPU time used by the tasks in nanoseconds
+# TYPE kibana_os_cgroup_cpuacct_usage_nanos_total counter
+kibana_os_cgroup_cpuacct_usage_nanos_total 1.546820134e+09
+# HELP kibana_os_cgroup_cpu_throttled_periods_total Kibana cgroup count of CFS periods the tasks were throttled
+# TYPE kibana_os_cgroup_cpu_throttled_periods_total counter
+kibana_os_cgroup_cpu_throttled_periods_total 12
+# HELP kibana_os_cgroup_memory_current_in_bytes Kibana cgroup memory usage in bytes
+# TYPE kibana_os_cgroup_memory_current_in_bytes gauge
+kibana_os_cgroup_memory_current_in_bytes 6.0424192e+08
+`,
+	},
+}
+
+func TestExporterMemory(t *testing.T) {
+	for _, mt := range memoryTests {
+		t.Run(mt.desc, func(t *testing.T) {
+			target, stop := newTargetCollector(t, mt.fixture)
+			defer stop()
+
+			if err := testutil.CollectAndCompare(target, strings.NewReader(mt.expected),
+				"kibana_heap_size_limit_in_bytes",
+				"kibana_resident_set_size_in_bytes",
+				"kibana_os_info",
+				"kibana_os_memory_free_in_bytes",
+				"kibana_os_millis_uptime",
+				"kibana_os_cgroup_cpu_cfs_quota_micros",
+				"kibana_os_cgroup_cpuacct_usage_nanos_total",
+				"kibana_os_cgroup_cpu_throttled_periods_total",
+				"kibana_os_cgroup_memory_current_in_bytes",
+			); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// up and scrape errors tests
+var upTests = []struct {
+	desc    string
+	handler http.HandlerFunc
+	up      int
+	reason  string
+}{
+	{
+		desc: "valid response",
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `{"status":{"overall":{"level":"available"}}}`)
+		},
+		up: 1,
+	},
+	{
+		desc: "invalid status code",
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		},
+		up:     0,
+		reason: ScrapeErrorHttpStatus,
+	},
+	{
+		desc: "invalid content",
+		handler: func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `<html>not a status</html>`)
+		},
+		up:     0,
+		reason: ScrapeErrorDecode,
+	},
+	{
+		desc:   "unreachable",
+		up:     0,
+		reason: ScrapeErrorConnect,
+	},
+}
+
+func TestExporterUp(t *testing.T) {
+	for _, ut := range upTests {
+		t.Run(ut.desc, func(t *testing.T) {
+			server := httptest.NewServer(ut.handler)
+			defer server.Close()
+			if ut.handler == nil {
+				server.Close()
+			}
+
+			target := newExporterTarget(t, server.URL, true)
+
+			var expected strings.Builder
+			fmt.Fprintf(&expected, `
+# HELP kibana_up Kibana api/status could be scraped (0: down, 1:up)
+# TYPE kibana_up gauge
+kibana_up %d
+# HELP kibana_scrape_errors_total Kibana scrape errors count by reason (connect, http_status, decode, credentials)
+# TYPE kibana_scrape_errors_total counter
+`, ut.up)
+			for _, reason := range ScrapeErrorReasons {
+				count := 0
+				if reason == ut.reason {
+					count = 1
+				}
+				fmt.Fprintf(&expected, "kibana_scrape_errors_total{reason=%q} %d\n", reason, count)
+			}
+			if err := testutil.CollectAndCompare(target, strings.NewReader(expected.String()), "kibana_up", "kibana_scrape_errors_total"); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestExporterNoStaleValues(t *testing.T) {
+	green := newStatusServer(t, "status_v8.json", nil)
+	defer green.Close()
+	yellow := newStatusServer(t, "status_v7.json", nil)
+	defer yellow.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	defer down.Close()
+
+	collectors := make([]*KibanaCollector, 0)
+	for name, uri := range map[string]string{"green": green.URL, "yellow": yellow.URL, "down": down.URL} {
+		collector := newKibanaCollector(t, &config.KibanaConfig{Name: name}, uri)
+		collectors = append(collectors, collector)
+	}
+	exporter, err := NewExporter("kibana", collectors, false, true, "", nil)
+	if err != nil {
+		t.Fatalf("NewExporter failed with valid input")
+	}
+
+	heapUsed := `
+# HELP kibana_heap_used_in_bytes Kibana Heap usage in bytes
+# TYPE kibana_heap_used_in_bytes gauge
+`
+	// each scrape only exports the values of the current target, even when
+	// Kibana is not green and whatever the previous target was.
+	for _, st := range []struct{ target, expected string }{
+		{"green", heapUsed + "kibana_heap_used_in_bytes 3.52316336e+08\n"},
+		{"yellow", heapUsed + "kibana_heap_used_in_bytes 2.98456712e+08\n"},
+		{"down", ""},
+		{"green", heapUsed + "kibana_heap_used_in_bytes 3.52316336e+08\n"},
+	} {
+		target := exporter.NewTargetCollector(context.Background(), exporter.FindTarget(st.target))
+		if err := testutil.CollectAndCompare(target, strings.NewReader(st.expected), "kibana_heap_used_in_bytes"); err != nil {
+			t.Errorf("target %s: %s", st.target, err)
+		}
+	}
+}
+
+// TestConcurrentTargets scrapes several targets at the same time through the
+// same exporter; each fake Kibana only answers once all the scrapes are in
+// progress, so it fails if scrapes are serialized. Run it with -race.
+func TestConcurrentTargets(t *testing.T) {
+	const targets = 10
+
+	var arrived sync.WaitGroup
+	arrived.Add(targets)
+	allArrived := make(chan struct{})
+	go func() {
+		arrived.Wait()
+		close(allArrived)
+	}()
+
+	collectors := make([]*KibanaCollector, 0, targets)
+	for i := 0; i < targets; i++ {
+		connections := i
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			arrived.Done()
+			select {
+			case <-allArrived:
+			case <-time.After(5 * time.Second):
+				http.Error(w, "scrapes are serialized", http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprintf(w, `{"status":{"overall":{"level":"available"}},"metrics":{"concurrent_connections":%d}}`, connections)
+		}))
+		defer server.Close()
+
+		collector := newKibanaCollector(t, &config.KibanaConfig{Name: fmt.Sprintf("kibana-%d", i)}, server.URL)
+		collectors = append(collectors, collector)
+	}
+	exporter, err := NewExporter("kibana", collectors, false, true, "", nil)
+	if err != nil {
+		t.Fatalf("NewExporter failed with valid input")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < targets; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			target := exporter.NewTargetCollector(context.Background(), exporter.FindTarget(fmt.Sprintf("kibana-%d", i)))
+			expected := fmt.Sprintf(`
+# HELP kibana_concurrent_connections Kibana Concurrent Connections
+# TYPE kibana_concurrent_connections gauge
+kibana_concurrent_connections %d
+`, i)
+			if err := testutil.CollectAndCompare(target, strings.NewReader(expected), "kibana_concurrent_connections"); err != nil {
+				t.Errorf("target kibana-%d: %s", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// loadConfig loads the config file with content.
+func loadConfig(t *testing.T, content string) *config.KibanaConfigs {
+	dir, err := ioutil.TempDir("", "kibana-exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "kibana.yml")
+	if err := ioutil.WriteFile(configFile, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	kibanas, err := config.Load(configFile)
+	if err != nil {
+		t.Fatalf("Load failed with valid input: %s", err)
+	}
+	return kibanas
+}
+
+func TestFindURLTarget(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer dG9rZW4=" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"status":{"overall":{"level":"available"}}}`)
+	}))
+	defer server.Close()
+
+	kibanas := loadConfig(t, `
+modules:
+  prod:
+    bearer_token: dG9rZW4=
+target_allowlist: 'http://127\.0\.0\.1:[0-9]+/?'
+`)
+
+	exporter, err := NewExporter("kibana", []*KibanaCollector{}, false, true, "", nil)
+	if err != nil {
+		t.Fatalf("NewExporter failed with valid input")
+	}
+	if _, err := exporter.FindURLTarget(server.URL, "prod"); err == nil {
+		t.Errorf("expected an error without config")
+	}
+	exporter.Config = kibanas
+
+	collector, err := exporter.FindURLTarget(server.URL, "prod")
+	if err != nil {
+		t.Fatalf("FindURLTarget failed with valid input: %s", err)
+	}
+	// the collector is kept for the next scrapes
+	if again, _ := exporter.FindURLTarget(server.URL, "prod"); again != collector {
+		t.Errorf("expected the same collector for the same target and module")
+	}
+	// same URL once normalized
+	if again, _ := exporter.FindURLTarget(server.URL+"/", "prod"); again != collector {
+		t.Errorf("expected the same collector for the same normalized URL")
+	}
+	// the default module
+	first, err := exporter.FindURLTarget(server.URL, "")
+	if err != nil {
+		t.Fatalf("FindURLTarget failed with valid input: %s", err)
+	}
+	if again, _ := exporter.FindURLTarget(server.URL, "default"); again != first {
+		t.Errorf("expected the same collector for the empty and default modules")
+	}
+	if _, err := exporter.FindURLTarget(server.URL, "unknown"); err == nil {
+		t.Errorf("expected an error for an unknown module")
+	}
+	if _, err := exporter.FindURLTarget("http://kibana.corp:5601", "prod"); err == nil {
+		t.Errorf("expected an error for a target not allowed")
+	}
+
+	target := exporter.NewTargetCollector(context.Background(), collector)
+	expected := `
+# HELP kibana_up Kibana api/status could be scraped (0: down, 1:up)
+# TYPE kibana_up gauge
+kibana_up 1
+`
+	if err := testutil.CollectAndCompare(target, strings.NewReader(expected), "kibana_up"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestURLTargetsEviction(t *testing.T) {
+	kibanas := loadConfig(t, `
+modules:
+  default: {}
+target_allowlist: 'http://127\.0\.0\.1:[0-9]+'
+`)
+	exporter, err := NewExporter("kibana", []*KibanaCollector{}, false, true, "", nil)
+	if err != nil {
+		t.Fatalf("NewExporter failed with valid input")
+	}
+	exporter.Config = kibanas
+	exporter.maxURLTargets = 2
+
+	first, _ := exporter.FindURLTarget("http://127.0.0.1:1", "")
+	exporter.FindURLTarget("http://127.0.0.1:2", "")
+	// used again: the second one is the least recently used
+	exporter.FindURLTarget("http://127.0.0.1:1", "")
+	exporter.FindURLTarget("http://127.0.0.1:3", "")
+	if len(exporter.urlTargets) != 2 || exporter.urlTargetsLRU.Len() != 2 {
+		t.Fatalf("expected 2 collectors kept, got %d", len(exporter.urlTargets))
+	}
+	if again, _ := exporter.FindURLTarget("http://127.0.0.1:1", ""); again != first {
+		t.Errorf("expected the most recently used collector to be kept")
+	}
+	if _, ok := exporter.urlTargets["default http://127.0.0.1:2"]; ok {
+		t.Errorf("expected the least recently used collector to be dropped")
+	}
+}
+
+func TestCloseIdleConnections(t *testing.T) {
+	content, err := ioutil.ReadFile(filepath.Join("testdata", "status_v8.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := make(chan struct{}, 1)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content) // nolint: errcheck
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed <- struct{}{}
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	target := newExporterTarget(t, server.URL, false)
+	if _, err := target.target.scrape(context.Background()); err != nil {
+		t.Fatalf("scrape failed with valid input: %s", err)
+	}
+	select {
+	case <-closed:
+		t.Fatalf("expected the connection to be kept after the scrape")
+	default:
+	}
+	target.exporter.CloseIdleConnections()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Errorf("expected the idle connection to be closed")
+	}
+}
+
+func TestNewExporterDuplicateNames(t *testing.T) {
+	colls := make([]*KibanaCollector, 0)
+	for i := 0; i < 2; i++ {
+		collector := newKibanaCollector(t, &config.KibanaConfig{Name: "kibana"}, "http://localhost:5601")
+		colls = append(colls, collector)
+	}
+	if _, err := NewExporter("kibana", colls, false, true, "", nil); err == nil {
+		t.Errorf("expected error for duplicate target names")
+	}
+}
+
+func TestTargetLabels(t *testing.T) {
+	server := newStatusServer(t, "status_v8.json", nil)
+	defer server.Close()
+
+	kibana := &config.KibanaConfig{Name: "kibana-1", Labels: map[string]string{"env": "prod"}}
+	collector := newKibanaCollector(t, kibana, server.URL)
+	exporter, err := NewExporter("kibana", []*KibanaCollector{collector}, false, true, "instance_name", nil)
+	if err != nil {
+		t.Fatalf("NewExporter failed with valid input: %s", err)
+	}
+	registry := prometheus.NewRegistry()
+	if err := exporter.Register(registry, context.Background(), collector); err != nil {
+		t.Fatalf("Register failed with valid input: %s", err)
+	}
+
+	expected := `
+# HELP kibana_up Kibana api/status could be scraped (0: down, 1:up)
+# TYPE kibana_up gauge
+kibana_up{env="prod",instance_name="kibana-1"} 1
+# HELP kibana_status_level Kibana overall status as a state set: 1 for the current level, 0 for the others
+# TYPE kibana_status_level gauge
+kibana_status_level{env="prod",instance_name="kibana-1",level="available"} 1
+kibana_status_level{env="prod",instance_name="kibana-1",level="critical"} 0
+kibana_status_level{env="prod",instance_name="kibana-1",level="degraded"} 0
+kibana_status_level{env="prod",instance_name="kibana-1",level="unavailable"} 0
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "kibana_up", "kibana_status_level"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTargetLabelsConflicts(t *testing.T) {
+	for _, lt := range []struct {
+		desc, targetLabel string
+		labels            map[string]string
+		collectors        []string
+		valid             bool
+	}{
+		{"label of a metric", "", map[string]string{"level": "high"}, nil, false},
+		{"label of a metric of a collector", "", map[string]string{"host": "kibana-1"}, []string{config.CollectorStats}, false},
+		{"label of a metric of a collector not run", "", map[string]string{"host": "kibana-1"}, nil, true},
+		{"target label", "instance_name", map[string]string{"instance_name": "kibana"}, nil, false},
+		{"invalid target label", "instance-name", nil, nil, false},
+	} {
+		t.Run(lt.desc, func(t *testing.T) {
+			collector := newKibanaCollector(t, &config.KibanaConfig{Name: "kibana"}, "http://localhost:5601")
+			// rejected by the config too, checked again whatever the config
+			collector.kibana.Labels = lt.labels
+			collector.kibana.Collectors = lt.collectors
+			_, err := NewExporter("kibana", []*KibanaCollector{collector}, false, true, lt.targetLabel, nil)
+			if lt.valid && err != nil {
+				t.Errorf("NewExporter failed with valid input: %s", err)
+			}
+			if !lt.valid && err == nil {
+				t.Errorf("expected an error for conflicting labels")
+			}
+		})
+	}
+}
+
+// TestMetricLabels checks that the labels of the metrics are the ones the
+// config rejects as static labels.
+// newKibanaCollector returns the collector of the target kibana located at uri.
+func newKibanaCollector(t *testing.T, kibana *config.KibanaConfig, uri string) *KibanaCollector {
+	if err := kibana.SetDefault(uri, false, false); err != nil {
+		t.Fatalf("SetDefault failed with valid input: %s", err)
+	}
+	collector, err := NewCollector(kibana, nil)
+	if err != nil {
+		t.Fatalf("NewCollector failed with valid input: %s", err)
+	}
+	return collector
+}
+
+// newExporterTarget returns the collector of the metrics of a target located
+// at uri, exported alone.
+func newExporterTarget(t *testing.T, uri string, legacyStatus bool) *TargetCollector {
+	collector := newKibanaCollector(t, &config.KibanaConfig{Name: "default"}, uri)
+	exporter, err := NewExporter("kibana", []*KibanaCollector{collector}, false, legacyStatus, "", nil)
+	if err != nil {
+		t.Fatalf("NewExporter failed with valid input: %s", err)
+	}
+	return exporter.NewTargetCollector(context.Background(), collector)
+}
+
+// newTargetCollector returns the collector of the metrics of a target scraping
+// a fake Kibana serving the api/status fixture, and the function stopping it.
+func newTargetCollector(t *testing.T, fixture string) (*TargetCollector, func()) {
+	server := newStatusServer(t, fixture, nil)
+	return newExporterTarget(t, server.URL, true), server.Close
+}
+
+// newCollectorRegistry registers a target with the optional collector name
+// scraping a fake Kibana serving fixtures.
+func newCollectorRegistry(t *testing.T, name string, fixtures map[string]string) (*prometheus.Registry, func()) {
+	return newServerRegistry(t, name, newKibanaServer(t, fixtures))
+}
+
+// newServerRegistry registers the collector of a target served by server
+// running the optional collector name; the function returned stops server.
+func newServerRegistry(t *testing.T, name string, server *httptest.Server) (*prometheus.Registry, func()) {
+	collector := newKibanaCollector(t, &config.KibanaConfig{Name: "kibana", Collectors: []string{name}}, server.URL)
+	exporter, err := NewExporter("kibana", []*KibanaCollector{collector}, false, true, "", nil)
+	if err != nil {
+		t.Fatalf("NewExporter failed with valid input: %s", err)
+	}
+	registry := prometheus.NewRegistry()
+	if err := exporter.Register(registry, context.Background(), collector); err != nil {
+		t.Fatalf("Register failed with valid input: %s", err)
+	}
+	return registry, server.Close
+}
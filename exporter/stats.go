@@ -0,0 +1,141 @@
+package exporter
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/go-kit/log/level"
+	"github.com/peekjef72/kibana-prometheus-exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// KibanaStats is used to unmarshal the response of api/stats?extended=true.
+type KibanaStats struct {
+	Kibana struct {
+		Uuid             string `json:"uuid"`
+		Name             string `json:"name"`
+		Host             string `json:"host"`
+		TransportAddress string `json:"transport_address"`
+	} `json:"kibana"`
+	// extended only: uuid of the Elasticsearch cluster
+	ClusterUuid string `json:"cluster_uuid,omitempty"`
+	// extended only: data of the usage collectors, with exclude_usage=false
+	// before 8.x; empty or missing otherwise
+	Usage struct {
+		// totals of the saved objects by type, like {"dashboard": {"total": 3}};
+		// other entries (index...) are not totals
+		Kibana map[string]interface{} `json:"kibana"`
+	} `json:"usage"`
+}
+
+// savedObjects returns the total of saved objects by type found in the usage.
+func (s *KibanaStats) savedObjects() map[string]float64 {
+	totals := make(map[string]float64, len(s.Usage.Kibana))
+	for name, value := range s.Usage.Kibana {
+		usage, ok := value.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if total, ok := usage["total"].(float64); ok {
+			totals[name] = total
+		}
+	}
+	return totals
+}
+
+// statsPath is the path of the extended stats of Kibana.
+const statsPath = "/api/stats?extended=true"
+
+// scrapeStats requests api/stats?extended=true from Kibana. The usage is
+// excluded by default since 7.11 and asked for with exclude_usage=false;
+// 8.x doesn't send it anymore. A Kibana rejecting the parameter sends the
+// usage by default: the parameter is not sent to it again.
+func (c *KibanaCollector) scrapeStats(ctx context.Context) (*KibanaStats, error) {
+	stats := &KibanaStats{}
+	if !c.rejectsExcludeUsage() {
+		serr := c.fetch(ctx, statsPath+"&exclude_usage=false", stats)
+		if serr == nil {
+			return stats, nil
+		}
+		if serr.StatusCode != http.StatusBadRequest {
+			return nil, serr
+		}
+		level.Debug(c.logger).
+			Log("msg", "api/stats rejected exclude_usage, requesting it without")
+		c.lock.Lock()
+		c.noExcludeUsage = true
+		c.lock.Unlock()
+	}
+	if serr := c.fetch(ctx, statsPath, stats); serr != nil {
+		return nil, serr
+	}
+	return stats, nil
+}
+
+// rejectsExcludeUsage tells if api/stats rejected the exclude_usage parameter.
+func (c *KibanaCollector) rejectsExcludeUsage() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.noExcludeUsage
+}
+
+// setStatsIdentifiers keeps the identifiers of the last successful scrape of
+// api/stats for kibana_info.
+func (c *KibanaCollector) setStatsIdentifiers(stats *KibanaStats) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.statsIdentifiers = []string{stats.Kibana.Uuid, stats.Kibana.Name, stats.Kibana.Host,
+		stats.Kibana.TransportAddress, stats.ClusterUuid}
+}
+
+// StatsIdentifiers returns the identifiers of the last successful scrape of
+// api/stats, the values of config.StatsInfoLabels; empty until then.
+func (c *KibanaCollector) StatsIdentifiers() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.statsIdentifiers == nil {
+		return make([]string, len(config.StatsInfoLabels))
+	}
+	return append([]string{}, c.statsIdentifiers...)
+}
+
+//*************************************************************************************************
+
+// statsDescs holds the descriptions of the metrics of the stats collector.
+type statsDescs struct {
+	// kibana_info with the identifiers for the targets running the collector
+	info         *prometheus.Desc
+	savedObjects *prometheus.Desc
+}
+
+func newStatsDescs(namespace string) *statsDescs {
+	return &statsDescs{
+		info: newDesc(namespace, "info",
+			"Kibana overall info, version build, instance and Elasticsearch cluster identifiers; see labels, always 1",
+			append(append([]string{}, config.InfosLabels...), config.StatsInfoLabels...)),
+		savedObjects: newDesc(namespace, "stats_usage_saved_objects",
+			"Kibana count of saved objects by type (dashboard, visualization, search, index_pattern...)", config.StatsSavedObjectsLabels),
+	}
+}
+
+// describe sends the descriptions of the metrics of the stats collector.
+func (d *statsDescs) describe(ch chan<- *prometheus.Desc) {
+	ch <- d.info
+	ch <- d.savedObjects
+}
+
+// collectStats scrapes the extended stats of the target, keeps the instance
+// and cluster identifiers for kibana_info and sends the usage metrics.
+func (e *Exporter) collectStats(ctx context.Context, target *KibanaCollector, ch chan<- prometheus.Metric) error {
+	stats, err := target.scrapeStats(ctx)
+	if err != nil {
+		return err
+	}
+	target.setStatsIdentifiers(stats)
+
+	for name, total := range stats.savedObjects() {
+		gauge(ch, e.stats.savedObjects, total, name)
+	}
+
+	return nil
+}
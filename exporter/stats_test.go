@@ -0,0 +1,194 @@
+package exporter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/peekjef72/kibana-prometheus-exporter/config"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// statsHandler serves the status and the stats fixtures like Kibana does:
+// the usage is only sent with exclude_usage=false, or exclude_usage is
+// rejected when reject is set. The queries of api/stats are added to queries.
+func statsHandler(t *testing.T, status, fixture string, reject bool, queries *[]string) http.Handler {
+	statusContent, err := ioutil.ReadFile(filepath.Join("testdata", status))
+	if err != nil {
+		t.Fatalf("can't read fixture %s: %s", status, err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join("testdata", fixture))
+	if err != nil {
+		t.Fatalf("can't read fixture %s: %s", fixture, err)
+	}
+	var lock sync.Mutex
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api/status":
+			w.Write(statusContent) // nolint: errcheck
+		case "/api/stats":
+			lock.Lock()
+			*queries = append(*queries, r.URL.RawQuery)
+			lock.Unlock()
+			param, set := r.URL.Query()["exclude_usage"]
+			if set && reject {
+				http.Error(w, `{"statusCode":400,"error":"Bad Request","message":"[request query.exclude_usage]: definition for this key is missing"}`, http.StatusBadRequest)
+				return
+			}
+			if !reject && (!set || param[0] != "false") {
+				stats := make(map[string]interface{})
+				json.Unmarshal(content, &stats) // nolint: errcheck
+				delete(stats, "usage")
+				json.NewEncoder(w).Encode(stats) // nolint: errcheck
+				return
+			}
+			w.Write(content) // nolint: errcheck
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// stats tests
+var statsTests = []struct {
+	desc, status, fixture string
+	reject                bool
+	queries               []string
+	expected              string
+}{
+	{
+		desc:    "7.x usage asked for",
+		status:  "status_v7.json",
+		fixture: "stats_v7.json",
+		queries: []string{"extended=true&exclude_usage=false", "extended=true&exclude_usage=false"},
+		expected: `
+# HELP kibana_info Kibana overall info, version build, instance and Elasticsearch cluster identifiers; see labels, always 1
+# TYPE kibana_info gauge
+kibana_info{build="46635",cluster_uuid="q1p6hYkDRvm2tLqXVpUjzA",host="0.0.0.0",name="kibana-7",transport_address="0.0.0.0:5601",uuid="5b2de169-2785-441b-ae8c-186a1936b17d",version="7.17.1"} 1
+# HELP kibana_stats_usage_saved_objects Kibana count of saved objects by type (dashboard, visualization, search, index_pattern...)
+# TYPE kibana_stats_usage_saved_objects gauge
+kibana_stats_usage_saved_objects{type="dashboard"} 5
+kibana_stats_usage_saved_objects{type="graph_workspace"} 0
+kibana_stats_usage_saved_objects{type="index_pattern"} 2
+kibana_stats_usage_saved_objects{type="search"} 3
+kibana_stats_usage_saved_objects{type="timelion_sheet"} 0
+kibana_stats_usage_saved_objects{type="visualization"} 23
+`,
+	},
+	{
+		desc:    "exclude_usage rejected, usage sent by default",
+		status:  "status_v7.json",
+		fixture: "stats_v7.json",
+		reject:  true,
+		// not sent again after the first rejection
+		queries: []string{"extended=true&exclude_usage=false", "extended=true", "extended=true"},
+		expected: `
+# HELP kibana_info Kibana overall info, version build, instance and Elasticsearch cluster identifiers; see labels, always 1
+# TYPE kibana_info gauge
+kibana_info{build="46635",cluster_uuid="q1p6hYkDRvm2tLqXVpUjzA",host="0.0.0.0",name="kibana-7",transport_address="0.0.0.0:5601",uuid="5b2de169-2785-441b-ae8c-186a1936b17d",version="7.17.1"} 1
+# HELP kibana_stats_usage_saved_objects Kibana count of saved objects by type (dashboard, visualization, search, index_pattern...)
+# TYPE kibana_stats_usage_saved_objects gauge
+kibana_stats_usage_saved_objects{type="dashboard"} 5
+kibana_stats_usage_saved_objects{type="graph_workspace"} 0
+kibana_stats_usage_saved_objects{type="index_pattern"} 2
+kibana_stats_usage_saved_objects{type="search"} 3
+kibana_stats_usage_saved_objects{type="timelion_sheet"} 0
+kibana_stats_usage_saved_objects{type="visualization"} 23
+`,
+	},
+	{
+		// no usage: the saved objects are skipped
+		desc:    "8.x without usage",
+		status:  "status_v8.json",
+		fixture: "stats_v8.json",
+		queries: []string{"extended=true&exclude_usage=false", "extended=true&exclude_usage=false"},
+		expected: `
+# HELP kibana_info Kibana overall info, version build, instance and Elasticsearch cluster identifiers; see labels, always 1
+# TYPE kibana_info gauge
+kibana_info{build="50485",cluster_uuid="Fy4Swt5lSZmnOUw0EcFuoA",host="0.0.0.0",name="kibana-8",transport_address="0.0.0.0:5601",uuid="d4c6ef1a-9d11-4bd1-8c9e-5f8a4a6ae25b",version="8.1.0"} 1
+`,
+	},
+}
+
+func TestStats(t *testing.T) {
+	for _, st := range statsTests {
+		t.Run(st.desc, func(t *testing.T) {
+			queries := make([]string, 0)
+			server := httptest.NewServer(statsHandler(t, st.status, st.fixture, st.reject, &queries))
+			registry, stop := newServerRegistry(t, config.CollectorStats, server)
+			defer stop()
+
+			if err := testutil.GatherAndCompare(registry, strings.NewReader(st.expected),
+				"kibana_info", "kibana_stats_usage_saved_objects"); err != nil {
+				t.Error(err)
+			}
+			// scraped twice
+			if _, err := registry.Gather(); err != nil {
+				t.Fatalf("Gather failed with valid input: %s", err)
+			}
+			if strings.Join(queries, " ") != strings.Join(st.queries, " ") {
+				t.Errorf("expected queries %v, got %v", st.queries, queries)
+			}
+		})
+	}
+}
+
+func TestStatsDown(t *testing.T) {
+	queries := make([]string, 0)
+	handler := statsHandler(t, "status_v8.json", "stats_v8.json", false, &queries)
+	var down int32 = 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/stats" && atomic.LoadInt32(&down) == 1 {
+			http.Error(w, "Kibana is not ready yet", http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	registry, stop := newServerRegistry(t, config.CollectorStats, server)
+	defer stop()
+
+	identified := `
+# HELP kibana_collector_up Kibana endpoint of the optional collector could be scraped (0: down, 1:up)
+# TYPE kibana_collector_up gauge
+kibana_collector_up{collector="stats"} %d
+# HELP kibana_info Kibana overall info, version build, instance and Elasticsearch cluster identifiers; see labels, always 1
+# TYPE kibana_info gauge
+kibana_info{build="50485",cluster_uuid="Fy4Swt5lSZmnOUw0EcFuoA",host="0.0.0.0",name="kibana-8",transport_address="0.0.0.0:5601",uuid="d4c6ef1a-9d11-4bd1-8c9e-5f8a4a6ae25b",version="8.1.0"} 1
+`
+	for _, dt := range []struct {
+		desc     string
+		down     int32
+		expected string
+	}{
+		{
+			// no identifiers yet
+			desc: "never scraped",
+			down: 1,
+			expected: `
+# HELP kibana_collector_up Kibana endpoint of the optional collector could be scraped (0: down, 1:up)
+# TYPE kibana_collector_up gauge
+kibana_collector_up{collector="stats"} 0
+# HELP kibana_info Kibana overall info, version build, instance and Elasticsearch cluster identifiers; see labels, always 1
+# TYPE kibana_info gauge
+kibana_info{build="50485",cluster_uuid="",host="",name="",transport_address="",uuid="",version="8.1.0"} 1
+`,
+		},
+		{"scraped", 0, fmt.Sprintf(identified, 1)},
+		// the identifiers of the last scrape are kept
+		{"down", 1, fmt.Sprintf(identified, 0)},
+	} {
+		atomic.StoreInt32(&down, dt.down)
+		if err := testutil.GatherAndCompare(registry, strings.NewReader(dt.expected),
+			"kibana_collector_up", "kibana_info"); err != nil {
+			t.Errorf("%s: %s", dt.desc, err)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package exporter
+
+import (
+	"context"
+
+	"github.com/peekjef72/kibana-prometheus-exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TaskManagerStatuses lists every status api/task_manager/_health can report,
+// from the best to the worst.
+var TaskManagerStatuses = []string{"OK", "warn", "error"}
+
+// TaskManagerHealth is used to unmarshal the response of api/task_manager/_health.
+// The sections of stats are missing until the Task Manager has computed them.
+type TaskManagerHealth struct {
+	Status string `json:"status"`
+	Stats  struct {
+		Configuration *struct {
+			Status string `json:"status"`
+		} `json:"configuration,omitempty"`
+		Workload *struct {
+			Status string `json:"status"`
+			Value  struct {
+				// count of tasks by task type and by task status (idle, running...)
+				TaskTypes map[string]struct {
+					Status map[string]float64 `json:"status"`
+				} `json:"task_types"`
+				Overdue float64 `json:"overdue"`
+				// tasks to run per_minute, per_hour and per_day
+				CapacityRequirements map[string]float64 `json:"capacity_requirements,omitempty"`
+			} `json:"value"`
+		} `json:"workload,omitempty"`
+		Runtime *struct {
+			Status string `json:"status"`
+			Value  struct {
+				// percentiles (p50, p90...) of the delay of the tasks in milliseconds
+				Drift map[string]*float64 `json:"drift"`
+				// percentiles of the used workers in percent
+				Load map[string]*float64 `json:"load"`
+			} `json:"value"`
+		} `json:"runtime,omitempty"`
+		CapacityEstimation *struct {
+			Status string `json:"status"`
+			Value  struct {
+				Observed map[string]*float64 `json:"observed"`
+				Proposed map[string]*float64 `json:"proposed"`
+			} `json:"value"`
+		} `json:"capacity_estimation,omitempty"`
+	} `json:"stats"`
+}
+
+// sections returns the status of each section of stats found in the response.
+func (h *TaskManagerHealth) sections() map[string]string {
+	sections := make(map[string]string, 4)
+	if h.Stats.Configuration != nil {
+		sections["configuration"] = h.Stats.Configuration.Status
+	}
+	if h.Stats.Workload != nil {
+		sections["workload"] = h.Stats.Workload.Status
+	}
+	if h.Stats.Runtime != nil {
+		sections["runtime"] = h.Stats.Runtime.Status
+	}
+	if h.Stats.CapacityEstimation != nil {
+		sections["capacity_estimation"] = h.Stats.CapacityEstimation.Status
+	}
+	return sections
+}
+
+// scrapeTaskManager requests api/task_manager/_health from Kibana.
+func (c *KibanaCollector) scrapeTaskManager(ctx context.Context) (*TaskManagerHealth, error) {
+	health := &TaskManagerHealth{}
+	if serr := c.fetch(ctx, "/api/task_manager/_health", health); serr != nil {
+		return nil, serr
+	}
+	return health, nil
+}
+
+//*************************************************************************************************
+
+// capacity estimations exported, by section (observed or proposed) and key
+var taskManagerCapacity = []struct {
+	section, key, help string
+}{
+	{"observed", "observed_kibana_instances", "Kibana instances running the Task Manager"},
+	{"observed", "max_throughput_per_minute", "Maximum count of tasks the Kibana instances can run per minute"},
+	{"observed", "avg_required_throughput_per_minute", "Average count of tasks to run per minute"},
+	{"observed", "minutes_to_drain_overdue", "Minutes needed to run the overdue tasks"},
+	{"proposed", "provisioned_kibana", "Kibana instances provisioned to run the Task Manager"},
+	{"proposed", "min_required_kibana", "Minimum count of Kibana instances needed to run the tasks"},
+}
+
+// taskManagerDescs holds the descriptions of the metrics of the task_manager
+// collector.
+type taskManagerDescs struct {
+	status               *prometheus.Desc
+	statsStatus          *prometheus.Desc
+	workloadTasks        *prometheus.Desc
+	overdueTasks         *prometheus.Desc
+	capacityRequirements *prometheus.Desc
+	drift                *prometheus.Desc
+	load                 *prometheus.Desc
+	// in the order of taskManagerCapacity
+	capacity []*prometheus.Desc
+}
+
+func newTaskManagerDescs(namespace string) *taskManagerDescs {
+	descs := &taskManagerDescs{
+		status: newDesc(namespace, "task_manager_status",
+			"Kibana Task Manager health status as a state set: 1 for the current status (OK, warn, error), 0 for the others", config.TaskManagerStatusLabels),
+		statsStatus: newDesc(namespace, "task_manager_stats_status",
+			"Kibana Task Manager health status of each stat (configuration, workload, runtime, capacity_estimation), always 1; see status label", config.TaskManagerStatsStatusLabels),
+		workloadTasks: newDesc(namespace, "task_manager_workload_tasks",
+			"Kibana Task Manager count of tasks by task type and status", config.TaskManagerWorkloadLabels),
+		overdueTasks: newDesc(namespace, "task_manager_workload_overdue_tasks",
+			"Kibana Task Manager count of overdue tasks", nil),
+		capacityRequirements: newDesc(namespace, "task_manager_workload_capacity_requirements",
+			"Kibana Task Manager count of recurring tasks to run by period (per_minute, per_hour, per_day)", config.TaskManagerPeriodLabels),
+		drift: newDesc(namespace, "task_manager_drift_milliseconds",
+			"Kibana Task Manager delay of the tasks past their schedule in milliseconds by percentile", config.TaskManagerPercentileLabels),
+		load: newDesc(namespace, "task_manager_load_percent",
+			"Kibana Task Manager workers in use in percent by percentile", config.TaskManagerPercentileLabels),
+	}
+	for _, capacity := range taskManagerCapacity {
+		descs.capacity = append(descs.capacity, newDesc(namespace, "task_manager_capacity_"+capacity.key,
+			"Kibana Task Manager capacity estimation: "+capacity.help, nil))
+	}
+	return descs
+}
+
+// describe sends the descriptions of the metrics of the task_manager collector.
+func (d *taskManagerDescs) describe(ch chan<- *prometheus.Desc) {
+	ch <- d.status
+	ch <- d.statsStatus
+	ch <- d.workloadTasks
+	ch <- d.overdueTasks
+	ch <- d.capacityRequirements
+	ch <- d.drift
+	ch <- d.load
+	for _, desc := range d.capacity {
+		ch <- desc
+	}
+}
+
+// collectTaskManager scrapes the Task Manager health of the target and sends
+// its metrics; the stats missing from the response are skipped.
+func (e *Exporter) collectTaskManager(ctx context.Context, target *KibanaCollector, ch chan<- prometheus.Metric) error {
+	health, err := target.scrapeTaskManager(ctx)
+	if err != nil {
+		return err
+	}
+	d := e.taskManager
+
+	// state set like kibana_status_level
+	known := false
+	for _, status := range TaskManagerStatuses {
+		statusVal := 0.0
+		if status == health.Status {
+			statusVal = 1.0
+			known = true
+		}
+		gauge(ch, d.status, statusVal, status)
+	}
+	if !known && health.Status != "" {
+		gauge(ch, d.status, 1.0, health.Status)
+	}
+	for stat, status := range health.sections() {
+		gauge(ch, d.statsStatus, 1.0, stat, status)
+	}
+
+	if workload := health.Stats.Workload; workload != nil {
+		for taskType, tasks := range workload.Value.TaskTypes {
+			for status, count := range tasks.Status {
+				gauge(ch, d.workloadTasks, count, taskType, status)
+			}
+		}
+		gauge(ch, d.overdueTasks, workload.Value.Overdue)
+		for period, count := range workload.Value.CapacityRequirements {
+			gauge(ch, d.capacityRequirements, count, period)
+		}
+	}
+
+	if runtime := health.Stats.Runtime; runtime != nil {
+		for percentile, value := range runtime.Value.Drift {
+			if value != nil {
+				gauge(ch, d.drift, *value, percentile)
+			}
+		}
+		for percentile, value := range runtime.Value.Load {
+			if value != nil {
+				gauge(ch, d.load, *value, percentile)
+			}
+		}
+	}
+
+	if estimation := health.Stats.CapacityEstimation; estimation != nil {
+		sections := map[string]map[string]*float64{
+			"observed": estimation.Value.Observed,
+			"proposed": estimation.Value.Proposed,
+		}
+		for index, capacity := range taskManagerCapacity {
+			if value := sections[capacity.section][capacity.key]; value != nil {
+				gauge(ch, d.capacity[index], *value)
+			}
+		}
+	}
+
+	return nil
+}
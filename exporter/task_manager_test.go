@@ -0,0 +1,97 @@
+package exporter
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/peekjef72/kibana-prometheus-exporter/config"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestOptionalCollectors(t *testing.T) {
+	for _, name := range config.OptionalCollectors {
+		if _, ok := optionalCollectors[name]; !ok {
+			t.Errorf("no collector for %s", name)
+		}
+	}
+}
+
+func TestTaskManager(t *testing.T) {
+	registry, stop := newCollectorRegistry(t, config.CollectorTaskManager, map[string]string{
+		"/api/status":               "status_v8.json",
+		"/api/task_manager/_health": "task_manager_health.json",
+	})
+	defer stop()
+
+	expected := `
+# HELP kibana_collector_up Kibana endpoint of the optional collector could be scraped (0: down, 1:up)
+# TYPE kibana_collector_up gauge
+kibana_collector_up{collector="task_manager"} 1
+# HELP kibana_task_manager_status Kibana Task Manager health status as a state set: 1 for the current status (OK, warn, error), 0 for the others
+# TYPE kibana_task_manager_status gauge
+kibana_task_manager_status{status="OK"} 0
+kibana_task_manager_status{status="error"} 0
+kibana_task_manager_status{status="warn"} 1
+# HELP kibana_task_manager_stats_status Kibana Task Manager health status of each stat (configuration, workload, runtime, capacity_estimation), always 1; see status label
+# TYPE kibana_task_manager_stats_status gauge
+kibana_task_manager_stats_status{stat="capacity_estimation",status="OK"} 1
+kibana_task_manager_stats_status{stat="configuration",status="OK"} 1
+kibana_task_manager_stats_status{stat="runtime",status="warn"} 1
+kibana_task_manager_stats_status{stat="workload",status="OK"} 1
+# HELP kibana_task_manager_workload_tasks Kibana Task Manager count of tasks by task type and status
+# TYPE kibana_task_manager_workload_tasks gauge
+kibana_task_manager_workload_tasks{status="claiming",task_type="report:execute"} 1
+kibana_task_manager_workload_tasks{status="failed",task_type="report:execute"} 1
+kibana_task_manager_workload_tasks{status="idle",task_type="actions_telemetry"} 1
+kibana_task_manager_workload_tasks{status="idle",task_type="alerting:.es-query"} 3
+kibana_task_manager_workload_tasks{status="running",task_type="alerting:.es-query"} 1
+# HELP kibana_task_manager_workload_overdue_tasks Kibana Task Manager count of overdue tasks
+# TYPE kibana_task_manager_workload_overdue_tasks gauge
+kibana_task_manager_workload_overdue_tasks 3
+# HELP kibana_task_manager_drift_milliseconds Kibana Task Manager delay of the tasks past their schedule in milliseconds by percentile
+# TYPE kibana_task_manager_drift_milliseconds gauge
+kibana_task_manager_drift_milliseconds{percentile="p50"} 1561
+kibana_task_manager_drift_milliseconds{percentile="p90"} 3055
+kibana_task_manager_drift_milliseconds{percentile="p95"} 3092
+kibana_task_manager_drift_milliseconds{percentile="p99"} 64815
+# HELP kibana_task_manager_capacity_min_required_kibana Kibana Task Manager capacity estimation: Minimum count of Kibana instances needed to run the tasks
+# TYPE kibana_task_manager_capacity_min_required_kibana gauge
+kibana_task_manager_capacity_min_required_kibana 1
+# HELP kibana_task_manager_capacity_max_throughput_per_minute Kibana Task Manager capacity estimation: Maximum count of tasks the Kibana instances can run per minute
+# TYPE kibana_task_manager_capacity_max_throughput_per_minute gauge
+kibana_task_manager_capacity_max_throughput_per_minute 200
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		"kibana_collector_up",
+		"kibana_task_manager_status",
+		"kibana_task_manager_stats_status",
+		"kibana_task_manager_workload_tasks",
+		"kibana_task_manager_workload_overdue_tasks",
+		"kibana_task_manager_drift_milliseconds",
+		"kibana_task_manager_capacity_min_required_kibana",
+		"kibana_task_manager_capacity_max_throughput_per_minute",
+	); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTaskManagerDown(t *testing.T) {
+	// Kibana is up, the Task Manager health isn't available
+	registry, stop := newCollectorRegistry(t, config.CollectorTaskManager, map[string]string{
+		"/api/status": "status_v8.json",
+	})
+	defer stop()
+
+	expected := `
+# HELP kibana_up Kibana api/status could be scraped (0: down, 1:up)
+# TYPE kibana_up gauge
+kibana_up 1
+# HELP kibana_collector_up Kibana endpoint of the optional collector could be scraped (0: down, 1:up)
+# TYPE kibana_collector_up gauge
+kibana_collector_up{collector="task_manager"} 0
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		"kibana_up", "kibana_collector_up", "kibana_task_manager_status"); err != nil {
+		t.Error(err)
+	}
+}
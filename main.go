@@ -1,16 +1,28 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
+	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/peekjef72/kibana-prometheus-exporter/config"
 	"github.com/peekjef72/kibana-prometheus-exporter/exporter"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
 	"github.com/prometheus/common/promlog"
 	"github.com/prometheus/common/promlog/flag"
@@ -22,107 +34,541 @@ import (
 var (
 	listenAddress  = kingpin.Flag("web.listen-address", "The address to listen on for HTTP requests.").Default(":9684").String()
 	metricsPath    = kingpin.Flag("web.telemetry-path", "The address to listen on for HTTP requests.").Default("/metrics").String()
+	webLifecycle   = kingpin.Flag("web.enable-lifecycle", "Enable the reload of the configuration by a POST to /-/reload.").Default("false").Bool()
 	configFile     = kingpin.Flag("config-file", "Exporter configuration file.").Short('c').Default("").String()
-	dry_run        = kingpin.Flag("dry-run", "Only check exporter configuration file and exit.").Short('n').Default("false").Bool()
+	dry_run        = kingpin.Flag("dry-run", "Scrape the target once, print its metrics and exit.").Short('n').Default("false").Bool()
 	kibanaURI      = kingpin.Flag("kibana.uri", "The Kibana API to fetch metrics from").Default("").String()
 	kibanaUsername = kingpin.Flag("kibana.username", "The username to use for Kibana API").Short('u').String()
 	kibanaPassword = kingpin.Flag("kibana.password", "The password to use for Kibana API").Short('p').String()
+	kibanaApiKey   = kingpin.Flag("kibana.api-key", "The Elasticsearch API key (base64 encoded id:api_key) to use for Kibana API").String()
+	kibanaToken    = kingpin.Flag("kibana.bearer-token", "The bearer token to use for Kibana API").String()
+
+	// credentials read from files on each scrape, not shown by ps
+	kibanaPasswordFile = kingpin.Flag("kibana.password-file", "File holding the password to use for Kibana API, read on each scrape").String()
+	kibanaApiKeyFile   = kingpin.Flag("kibana.api-key-file", "File holding the Elasticsearch API key to use for Kibana API, read on each scrape").String()
+	kibanaTokenFile    = kingpin.Flag("kibana.bearer-token-file", "File holding the bearer token to use for Kibana API, read on each scrape").String()
+
 	kibanaSkipTLS  = kingpin.Flag("kibana.skip-tls", "Skip TLS verification for TLS secured Kibana URLs").Short('d').Default("false").Bool()
+	kibanaTimeout  = kingpin.Flag("kibana.timeout", "Maximum duration of a scrape of the Kibana API").Default(config.DefaultTimeout.String()).Duration()
+	timeoutOffset  = kingpin.Flag("scrape.timeout-offset", "Offset to subtract from the Prometheus scrape timeout (X-Prometheus-Scrape-Timeout-Seconds header) to get the scrape deadline").Default("500ms").Duration()
+	kibanaHeaders  = kingpin.Flag("kibana.header", "Header to add to the requests to Kibana, as name=value (repeatable)").StringMap()
+	kibanaLabels   = kingpin.Flag("kibana.label", "Label to add to all the metrics, as name=value (repeatable)").StringMap()
+	kibanaProxyURL = kingpin.Flag("kibana.proxy-url", "Proxy (http, https or socks5 URL) to reach Kibana, default from HTTP_PROXY, HTTPS_PROXY and NO_PROXY").String()
+	kibanaNoProxy  = kingpin.Flag("kibana.no-proxy", "Comma separated hosts, domains, IPs or CIDRs to reach without proxy").String()
+	kibanaCollect  = kingpin.Flag("kibana.collector", "Optional collector to run besides api/status: task_manager, alerting, stats (repeatable)").Enums(config.OptionalCollectors...)
+	kibanaV8Format = kingpin.Flag("kibana.v8format", "Request the 8.x status format from Kibana 7.x (?v8format=true)").Default("false").Bool()
+	targetLabel    = kingpin.Flag("target-label", "Name of the label holding the name of the target added to all its metrics (for example instance_name), none if empty").Default("").String()
+	legacyStatus   = kingpin.Flag("kibana.legacy-status", "Export the kibana_status gauge (1: green/available, 0: otherwise) besides the kibana_status_level state set, use --no-kibana.legacy-status to disable").Default("true").Bool()
 	debug          = kingpin.Flag("debug", "Output verbose details during metrics collection, use for development only").Short('s').Default("false").Bool()
 	wait           = kingpin.Flag("wait", "Wait for Kibana to be responsive before starting, setting this to false would cause the exporter to error out instead of waiting").Short('w').Default("false").Bool()
 	target         = kingpin.Flag("target", "in try mode specify the target to check. Default is firstof the list").Short('t').String()
+	module         = kingpin.Flag("module", "in try mode the module of the target when it is an URL").String()
+	output         = kingpin.Flag("output", "in try mode the output format: text, openmetrics or json").Short('o').Default("text").Enum("text", "openmetrics", "json")
 	namespace      = "kibana"
 	exporter_name  = "kibana_exporter"
+
+	// commands; serve runs the exporter
+	serveCmd       = kingpin.Command("serve", "Run the exporter (default command).").Default()
+	checkConfigCmd = kingpin.Command("check-config", "Check the config file and exit: 0 if valid, 1 otherwise.")
+	probeCmd       = kingpin.Command("probe", "Scrape the targets once and exit: 0 if all were scraped, 1 if one failed, 2 on config error.")
+	probeTargets   = probeCmd.Arg("target", "Names or URLs of the targets to probe, all the targets of the config if not set").Strings()
+	probeJSON      = probeCmd.Flag("json", "Print the results as JSON instead of a table").Bool()
+)
+
+// exit codes of the commands
+const (
+	exitOK          = 0
+	exitFailure     = 1
+	exitConfigError = 2
+)
+
+// exporter's own metrics, added to the metrics of each target
+var (
+	configReloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: exporter_name,
+		Name:      "config_last_reload_successful",
+		Help:      "Whether the last configuration reload attempt was successful (1: success, 0: failure)",
+	})
+	configReloadSeconds = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: exporter_name,
+		Name:      "config_last_reload_success_timestamp_seconds",
+		Help:      "Timestamp of the last successful configuration reload",
+	})
 )
 
+//***********************************************************************************************
+// scrapeContext returns a context canceled when the request is, or when the
+// scrape timeout sent by Prometheus minus the offset is reached.
+func scrapeContext(r *http.Request, offset time.Duration) (context.Context, context.CancelFunc, error) {
+	header := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds")
+	if header == "" {
+		ctx, cancel := context.WithCancel(r.Context())
+		return ctx, cancel, nil
+	}
+	seconds, err := strconv.ParseFloat(header, 64)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse timeout from Prometheus header: %s", err)
+	}
+	timeout := time.Duration(seconds * float64(time.Second))
+	if timeout > offset {
+		timeout -= offset
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	return ctx, cancel, nil
+}
+
 //***********************************************************************************************
 func handler(w http.ResponseWriter, r *http.Request, kib_exporter *exporter.Exporter) {
 	params := r.URL.Query()
 	target := params.Get("target")
-	if target == "" {
-		kib_exporter.SetTarget(kib_exporter.Collectors[0])
-	} else {
-		found := kib_exporter.FindTarget(target)
-		if found == nil {
-			http.Error(w, "specified target not found!", 404)
+	var found *exporter.KibanaCollector
+	if len(kib_exporter.Collectors) > 0 {
+		found = kib_exporter.Collectors[0]
+	}
+	if target != "" {
+		var err error
+		found, err = findTarget(kib_exporter, target, params.Get("module"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		kib_exporter.SetTarget(found)
 	}
+	if found == nil {
+		http.Error(w, "specified target not found!", 404)
+		return
+	}
+	ctx, cancel, err := scrapeContext(r, *timeoutOffset)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer cancel()
+
+	// one collector per request: scrapes of different targets run in parallel
 	registry := prometheus.NewRegistry()
-	registry.MustRegister(kib_exporter)
+	if err := kib_exporter.Register(registry, ctx, found); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	registry.MustRegister(configReloadSuccess, configReloadSeconds)
 	h := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
 	h.ServeHTTP(w, r)
 }
 
 //***********************************************************************************************
-func main() {
+// loadConfig reads the configuration file if any, and the target set on the
+// command line that replaces the targets of the file.
+func loadConfig() (*config.KibanaConfigs, error) {
 	var kibanas *config.KibanaConfigs
 	var err error
-	zerolog.TimeFieldFormat = zerolog.TimeFormatUnixMs
-
-	logConfig := promlog.Config{}
-	flag.AddFlags(kingpin.CommandLine, &logConfig)
-
-	kingpin.Version(version.Print(exporter_name))
-	// kingpin.VersionFlag.Short('v')
-	kingpin.HelpFlag.Short('h')
-	kingpin.Parse()
-
-	logger := promlog.New(&logConfig)
-	level.Info(logger).Log("msg", fmt.Sprintf("Starting %s", exporter_name), "version", version.Info())
-	level.Info(logger).Log("msg", "Build context", "build_context", version.BuildContext())
 
 	// read the configuration if not empty
 	if *configFile != "" {
 		kibanas, err = config.Load(*configFile)
 		if err != nil {
-			level.Error(logger).Log("Errmsg", fmt.Sprintf("Error loading config: %s", err))
-			os.Exit(1)
+			return nil, fmt.Errorf("Error loading config: %s", err)
 		}
 	}
 
-	*kibanaURI = strings.TrimSpace(*kibanaURI)
-	*kibanaUsername = strings.TrimSpace(*kibanaUsername)
-	*kibanaPassword = strings.TrimSpace(*kibanaPassword)
-	*kibanaURI = strings.TrimSuffix(*kibanaURI, "/")
-
-	if *kibanaURI != "" {
+	uri := strings.TrimSuffix(strings.TrimSpace(*kibanaURI), "/")
+	if uri != "" {
 		kibana := &config.KibanaConfig{
-			Name:     "default",
-			Protocol: "",
-			Host:     "",
-			Port:     "",
-			Username: *kibanaUsername,
-			Password: *kibanaPassword,
-		}
-		kibana.SetDefault(*kibanaURI, *kibanaSkipTLS, *wait)
+			Name:        "default",
+			Protocol:    "",
+			Host:        "",
+			Port:        "",
+			Username:    strings.TrimSpace(*kibanaUsername),
+			Password:    strings.TrimSpace(*kibanaPassword),
+			ApiKey:      strings.TrimSpace(*kibanaApiKey),
+			BearerToken: strings.TrimSpace(*kibanaToken),
+
+			PasswordFile:    *kibanaPasswordFile,
+			ApiKeyFile:      *kibanaApiKeyFile,
+			BearerTokenFile: *kibanaTokenFile,
+		}
+		if *kibanaV8Format {
+			kibana.V8Format = "true"
+		}
+		kibana.Timeout = kibanaTimeout.String()
+		kibana.ProxyURL = strings.TrimSpace(*kibanaProxyURL)
+		kibana.NoProxy = *kibanaNoProxy
+		if len(*kibanaHeaders) > 0 {
+			kibana.Headers = *kibanaHeaders
+		}
+		if len(*kibanaLabels) > 0 {
+			kibana.Labels = *kibanaLabels
+		}
+		kibana.Collectors = *kibanaCollect
+		err = kibana.SetDefault(uri, *kibanaSkipTLS, *wait)
+		if err != nil {
+			return nil, fmt.Errorf("Error in command line config: %s", err)
+		}
+		if kibanas == nil {
+			kibanas = &config.KibanaConfigs{}
+		}
 		kibanas.Kibanas = make([]config.KibanaConfig, 0)
 		kibanas.Kibanas = append(kibanas.Kibanas, *kibana)
 	}
-	if kibanas == nil || len(kibanas.Kibanas) == 0 {
-		level.Error(logger).Log("Errmsg", "No config found.")
-		os.Exit(1)
+	if kibanas == nil || (len(kibanas.Kibanas) == 0 && len(kibanas.Modules) == 0) {
+		return nil, fmt.Errorf("No config found.")
 	}
-	if *dry_run {
-		level.Info(logger).Log("msg", "configuration OK.")
-		// os.Exit(0)
+	return kibanas, nil
+}
+
+//***********************************************************************************************
+// buildExporter loads the configuration and builds the collector of each
+// target; any error leaves the caller with its current exporter.
+func buildExporter(logger log.Logger) (*exporter.Exporter, error) {
+	kibanas, err := loadConfig()
+	if err != nil {
+		return nil, err
 	}
+	return newExporter(kibanas, logger)
+}
 
+// newExporter builds the collector of each target of kibanas and the
+// exporter of the targets, without scraping them.
+func newExporter(kibanas *config.KibanaConfigs, logger log.Logger) (*exporter.Exporter, error) {
 	collectors := make([]*exporter.KibanaCollector, 0)
-	for _, kibana := range kibanas.Kibanas {
-		collector, err := exporter.NewCollector(&kibana, logger)
+	for index := range kibanas.Kibanas {
+		kibana := &kibanas.Kibanas[index]
+		collector, err := exporter.NewCollector(kibana, logger)
 		if err != nil {
-			level.Error(logger).
-				Log("msg", fmt.Sprintf("error while initializing collector: %s", err))
+			return nil, fmt.Errorf("error while initializing collector %s: %s", kibana.Name, err)
 		}
 		collectors = append(collectors, collector)
 	}
-	kib_exporter, err := exporter.NewExporter(namespace, collectors, *debug, logger)
+	kib_exporter, err := exporter.NewExporter(namespace, collectors, *debug, *legacyStatus, *targetLabel, logger)
+	if err != nil {
+		return nil, fmt.Errorf("error while initializing exporter: %s", err)
+	}
+	kib_exporter.Config = kibanas
+	return kib_exporter, nil
+}
+
+//***********************************************************************************************
+// exporterHolder keeps the exporter built from the current configuration.
+// A reload builds a new exporter and swaps it in one step, so a request sees
+// either the old targets or the new ones.
+type exporterHolder struct {
+	logger  log.Logger
+	current atomic.Value
+	// only one reload at a time
+	lock sync.Mutex
+}
+
+func (h *exporterHolder) get() *exporter.Exporter {
+	return h.current.Load().(*exporter.Exporter)
+}
+
+// set replaces the current exporter, closing the idle connections of the
+// replaced one.
+func (h *exporterHolder) set(kib_exporter *exporter.Exporter) {
+	previous, _ := h.current.Load().(*exporter.Exporter)
+	h.current.Store(kib_exporter)
+	configReloadSuccess.Set(1)
+	configReloadSeconds.SetToCurrentTime()
+	if previous != nil {
+		previous.CloseIdleConnections()
+	}
+}
+
+// reload rebuilds the exporter from the configuration; if it fails the
+// current exporter is kept.
+func (h *exporterHolder) reload() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	level.Info(h.logger).Log("msg", "reloading configuration")
+	kib_exporter, err := buildExporter(h.logger)
+	if err != nil {
+		configReloadSuccess.Set(0)
+		level.Error(h.logger).Log("msg", "configuration not reloaded, keeping the current one", "Errmsg", err)
+		return err
+	}
+	h.set(kib_exporter)
+	level.Info(h.logger).Log("msg", "configuration reloaded", "targets", len(kib_exporter.Collectors))
+	return nil
+}
+
+// reloadHandler returns the handler of /-/reload, reloading the configuration
+// on a POST when enabled.
+func reloadHandler(holder *exporterHolder, enabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !enabled {
+			http.Error(w, "Lifecycle API is not enabled, see --web.enable-lifecycle.", http.StatusForbidden)
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "This endpoint requires a POST request.", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := holder.reload(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(w, "configuration reloaded") // nolint: errcheck
+	}
+}
+
+//***********************************************************************************************
+// findTarget returns the collector of target, a name of the config or an URL
+// scraped with the settings of module; nil if no target has this name.
+func findTarget(kib_exporter *exporter.Exporter, target string, module string) (*exporter.KibanaCollector, error) {
+	found := kib_exporter.FindTarget(target)
+	if found == nil && strings.Contains(target, "://") {
+		// not a name: scrape the URL with the settings of the module
+		return kib_exporter.FindURLTarget(target, module)
+	}
+	return found, nil
+}
+
+//***********************************************************************************************
+// checkConfig validates the config file for the check-config command.
+func checkConfig() int {
+	if *configFile == "" {
+		fmt.Fprintln(os.Stderr, "check-config: the config file must be set with --config-file")
+		return exitFailure
+	}
+	kibanas, err := config.Load(*configFile)
+	if err != nil {
+		if cerr, ok := err.(*config.ConfigError); ok {
+			for _, msg := range cerr.Errors {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", *configFile, msg)
+			}
+		} else {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", *configFile, err)
+		}
+		return exitFailure
+	}
+	// the flags applying to all the targets, like the target label
+	if _, err := newExporter(kibanas, log.NewNopLogger()); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", *configFile, err)
+		return exitFailure
+	}
+	fmt.Printf("%s: OK, %d targets, %d modules\n", *configFile, len(kibanas.Kibanas), len(kibanas.Modules))
+	return exitOK
+}
+
+//***********************************************************************************************
+// probe scrapes the targets concurrently once for the probe command: the
+// ones given on the command line, all the targets of the config otherwise.
+func probe(logger log.Logger) int {
+	kib_exporter, err := buildExporter(logger)
+	if err != nil {
+		level.Error(logger).Log("Errmsg", err)
+		return exitConfigError
+	}
+	targets := kib_exporter.Collectors
+	if len(*probeTargets) > 0 {
+		targets = make([]*exporter.KibanaCollector, 0, len(*probeTargets))
+		for _, name := range *probeTargets {
+			found, err := findTarget(kib_exporter, name, *module)
+			if err != nil {
+				level.Error(logger).Log("msg", "invalid target", "target", name, "Errmsg", err)
+				return exitConfigError
+			}
+			if found == nil {
+				level.Error(logger).Log("msg", "target not found in config file", "target", name)
+				return exitConfigError
+			}
+			targets = append(targets, found)
+		}
+	}
+	if len(targets) == 0 {
+		level.Error(logger).Log("msg", "no target in config file, set the URL of one")
+		return exitConfigError
+	}
+
+	results := exporter.ProbeAll(context.Background(), targets)
+	if *probeJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			level.Error(logger).Log("Errmsg", err)
+			return exitFailure
+		}
+	} else {
+		printProbeResults(os.Stdout, results)
+	}
+
+	status := exitOK
+	for _, result := range results {
+		if result.Failed() {
+			status = exitFailure
+		}
+	}
+	return status
+}
+
+// printProbeResults prints the results of the probe command as a table.
+func printProbeResults(out io.Writer, results []*exporter.ProbeResult) {
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tURL\tREACHABLE\tHTTP\tVERSION\tSTATUS\tLATENCY\tERROR")
+	for _, result := range results {
+		reachable := "no"
+		if result.Reachable {
+			reachable = "yes"
+		}
+		httpStatus := "-"
+		if result.HttpStatus != 0 {
+			httpStatus = strconv.Itoa(result.HttpStatus)
+		}
+		latency := time.Duration(result.Latency * float64(time.Second)).Round(time.Millisecond)
+		// first line only, a decode error holds the content received
+		errMsg := strings.SplitN(result.Error, "\n", 2)[0]
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", result.Name, result.Url, reachable, httpStatus,
+			orDash(result.Version), orDash(result.Status), latency, errMsg)
+	}
+	tw.Flush()
+}
+
+func orDash(val string) string {
+	if val == "" {
+		return "-"
+	}
+	return val
+}
+
+//***********************************************************************************************
+// jsonSample is a sample of the json output of --dry-run; summaries and
+// histograms give one sample per series, like the text format.
+type jsonSample struct {
+	Name   string            `json:"name"`
+	Type   string            `json:"type"`
+	Help   string            `json:"help"`
+	Labels map[string]string `json:"labels"`
+	Value  float64           `json:"value"`
+}
+
+// writeMetrics writes the metrics gathered by --dry-run in the format
+// (text, openmetrics or json).
+func writeMetrics(out io.Writer, mfs []*dto.MetricFamily, format string) error {
+	if format == "json" {
+		samples := make([]jsonSample, 0)
+		for _, mf := range mfs {
+			for _, m := range mf.GetMetric() {
+				samples = append(samples, metricSamples(mf, m)...)
+			}
+		}
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(samples)
+	}
+
+	expFormat := expfmt.FmtText
+	if format == "openmetrics" {
+		expFormat = expfmt.FmtOpenMetrics
+	}
+	enc := expfmt.NewEncoder(out, expFormat)
+	for _, mf := range mfs {
+		if err := enc.Encode(mf); err != nil {
+			return err
+		}
+	}
+	if closer, ok := enc.(expfmt.Closer); ok {
+		// This in particular takes care of the final "# EOF\n" line for OpenMetrics.
+		return closer.Close()
+	}
+	return nil
+}
+
+// scrapeFailed tells if the scrape of the target gathered by --dry-run
+// failed, from its kibana_up metric.
+func scrapeFailed(mfs []*dto.MetricFamily) bool {
+	for _, mf := range mfs {
+		if mf.GetName() != namespace+"_up" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			if m.GetGauge().GetValue() != 1 {
+				return true
+			}
+		}
+		return false
+	}
+	// no kibana_up: not scraped
+	return true
+}
+
+// metricSamples returns the samples of a metric for the json output.
+func metricSamples(mf *dto.MetricFamily, m *dto.Metric) []jsonSample {
+	sample := func(suffix string, value float64, extra ...string) jsonSample {
+		labels := make(map[string]string, len(m.GetLabel())+1)
+		for _, label := range m.GetLabel() {
+			labels[label.GetName()] = label.GetValue()
+		}
+		if len(extra) == 2 {
+			labels[extra[0]] = extra[1]
+		}
+		return jsonSample{
+			Name:   mf.GetName() + suffix,
+			Type:   strings.ToLower(mf.GetType().String()),
+			Help:   mf.GetHelp(),
+			Labels: labels,
+			Value:  value,
+		}
+	}
+
+	switch mf.GetType() {
+	case dto.MetricType_COUNTER:
+		return []jsonSample{sample("", m.GetCounter().GetValue())}
+	case dto.MetricType_GAUGE:
+		return []jsonSample{sample("", m.GetGauge().GetValue())}
+	case dto.MetricType_SUMMARY:
+		samples := make([]jsonSample, 0)
+		for _, q := range m.GetSummary().GetQuantile() {
+			samples = append(samples, sample("", q.GetValue(), "quantile", fmt.Sprint(q.GetQuantile())))
+		}
+		return append(samples,
+			sample("_sum", m.GetSummary().GetSampleSum()),
+			sample("_count", float64(m.GetSummary().GetSampleCount())))
+	case dto.MetricType_HISTOGRAM:
+		samples := make([]jsonSample, 0)
+		for _, b := range m.GetHistogram().GetBucket() {
+			samples = append(samples, sample("_bucket", float64(b.GetCumulativeCount()), "le", fmt.Sprint(b.GetUpperBound())))
+		}
+		samples = append(samples, sample("_bucket", float64(m.GetHistogram().GetSampleCount()), "le", "+Inf"))
+		return append(samples,
+			sample("_sum", m.GetHistogram().GetSampleSum()),
+			sample("_count", float64(m.GetHistogram().GetSampleCount())))
+	default:
+		return []jsonSample{sample("", m.GetUntyped().GetValue())}
+	}
+}
+
+//***********************************************************************************************
+func main() {
+	zerolog.TimeFieldFormat = zerolog.TimeFormatUnixMs
+
+	logConfig := promlog.Config{}
+	flag.AddFlags(kingpin.CommandLine, &logConfig)
+
+	kingpin.Version(version.Print(exporter_name))
+	// kingpin.VersionFlag.Short('v')
+	kingpin.HelpFlag.Short('h')
+	command := kingpin.Parse()
+
+	logger := promlog.New(&logConfig)
+	switch command {
+	case checkConfigCmd.FullCommand():
+		os.Exit(checkConfig())
+	case probeCmd.FullCommand():
+		os.Exit(probe(logger))
+	}
+
+	level.Info(logger).Log("msg", fmt.Sprintf("Starting %s", exporter_name), "version", version.Info())
+	level.Info(logger).Log("msg", "Build context", "build_context", version.BuildContext())
+
+	holder := &exporterHolder{logger: logger}
+	kib_exporter, err := buildExporter(logger)
 	if err != nil {
-		level.Error(logger).
-			Log("msg", fmt.Sprintf("error while initializing exporter: %s", err))
+		level.Error(logger).Log("Errmsg", err)
+		os.Exit(1)
 	}
+	holder.set(kib_exporter)
+	collectors := kib_exporter.Collectors
 
 	level.Info(logger).Log("msg", fmt.Sprintf("%s initialized", exporter_name))
 
@@ -130,38 +576,40 @@ func main() {
 
 		level.Info(logger).Log("msg", fmt.Sprintf("%s runs once in dry-mode (output to stdout).", exporter_name))
 
-		registry := prometheus.NewRegistry()
-		registry.MustRegister(kib_exporter)
-
 		var found_tg *exporter.KibanaCollector
 		if *target != "" {
-			found_tg = kib_exporter.FindTarget(*target)
+			found_tg, err = findTarget(kib_exporter, *target, *module)
+			if err != nil {
+				level.Error(logger).Log("msg", "invalid target", "target", *target, "Errmsg", err)
+				os.Exit(1)
+			}
 			if found_tg == nil {
 				level.Error(logger).Log("msg", "target not found in config file", "target", *target)
 				os.Exit(1)
 
 			}
-		} else {
+		} else if len(collectors) > 0 {
 			found_tg = collectors[0]
+		} else {
+			level.Error(logger).Log("msg", "no target in config file, set the URL of one with --target")
+			os.Exit(1)
+		}
+		registry := prometheus.NewRegistry()
+		if err := kib_exporter.Register(registry, context.Background(), found_tg); err != nil {
+			level.Error(logger).Log("Errmsg", err)
+			os.Exit(1)
 		}
-		kib_exporter.SetTarget(found_tg)
 		mfs, err := registry.Gather()
 		if err != nil {
 			level.Error(logger).Log("Errmsg", "Error gathering metrics", "err", err)
 			os.Exit(1)
 		}
-		enc := expfmt.NewEncoder(os.Stdout, expfmt.FmtText)
-
-		for _, mf := range mfs {
-			err := enc.Encode(mf)
-			if err != nil {
-				level.Error(logger).Log("Errmsg", err)
-				break
-			}
+		if err := writeMetrics(os.Stdout, mfs, *output); err != nil {
+			level.Error(logger).Log("Errmsg", err)
+			os.Exit(1)
 		}
-		if closer, ok := enc.(expfmt.Closer); ok {
-			// This in particular takes care of the final "# EOF\n" line for OpenMetrics.
-			closer.Close()
+		if scrapeFailed(mfs) {
+			os.Exit(exitFailure)
 		}
 		// if kibana.WaitKibana() {
 		// 	// blocking wait for Kibana to be responsive
@@ -172,11 +620,9 @@ func main() {
 		// 			Log("not waiting for Kibana to be responsive")
 		// 	}
 		// }
-		os.Exit(1)
+		os.Exit(exitOK)
 	}
 
-	prometheus.MustRegister(kib_exporter)
-
 	var landingPage = []byte(`<html>
 			<head><title>Kibana Exporter</title></head>
 			<body>
@@ -192,8 +638,19 @@ func main() {
 	})
 
 	http.HandleFunc(*metricsPath, func(w http.ResponseWriter, r *http.Request) {
-		handler(w, r, kib_exporter)
+		// scrapes in progress during a reload keep the previous exporter
+		handler(w, r, holder.get())
 	})
+	http.HandleFunc("/-/reload", reloadHandler(holder, *webLifecycle))
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			holder.reload() // nolint: errcheck
+		}
+	}()
+
 	level.Info(logger).Log("msg", "Listening on address", "address", *listenAddress)
 	if err := http.ListenAndServe(*listenAddress, nil); err != nil {
 		level.Error(logger).Log("msg", "Error starting HTTP server")
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// useConfigFile writes content to the config file of the exporter, set by
+// --config-file, and returns the function restoring the flag.
+func useConfigFile(t *testing.T, dir string, content string) func() {
+	file := filepath.Join(dir, "kibana.yml")
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	previous := *configFile
+	*configFile = file
+	return func() { *configFile = previous }
+}
+
+// scrape timeout tests
+var scrapeContextTests = []struct {
+	desc, header string
+	offset       time.Duration
+	// no deadline if 0
+	timeout time.Duration
+	valid   bool
+}{
+	{"no header", "", 500 * time.Millisecond, 0, true},
+	{"offset subtracted", "10", 500 * time.Millisecond, 9500 * time.Millisecond, true},
+	{"decimal timeout", "2.5", time.Second, 1500 * time.Millisecond, true},
+	{"timeout below the offset", "0.4", 500 * time.Millisecond, 400 * time.Millisecond, true},
+	{"timeout equal to the offset", "1", time.Second, time.Second, true},
+	{"invalid header", "ten", 500 * time.Millisecond, 0, false},
+}
+
+func TestScrapeContext(t *testing.T) {
+	for _, st := range scrapeContextTests {
+		r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if st.header != "" {
+			r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", st.header)
+		}
+		start := time.Now()
+		ctx, cancel, err := scrapeContext(r, st.offset)
+		if !st.valid {
+			if err == nil {
+				t.Errorf("%s: expected an error", st.desc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: scrapeContext failed with valid input: %s", st.desc, err)
+			continue
+		}
+		deadline, ok := ctx.Deadline()
+		cancel()
+		if st.timeout == 0 {
+			if ok {
+				t.Errorf("%s: expected no deadline, got %s", st.desc, deadline)
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("%s: expected a deadline", st.desc)
+			continue
+		}
+		if timeout := deadline.Sub(start); timeout < st.timeout || timeout > st.timeout+time.Second {
+			t.Errorf("%s: expected a timeout of %s, got %s", st.desc, st.timeout, timeout)
+		}
+	}
+}
+
+func TestHandlerScrapeTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kibana-exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	done := make(chan struct{})
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer hung.Close()
+	defer close(done)
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"status":{"overall":{"level":"available"}}}`)
+	}))
+	defer up.Close()
+
+	previous := *timeoutOffset
+	*timeoutOffset = 500 * time.Millisecond
+	defer func() { *timeoutOffset = previous }()
+
+	for _, ht := range []struct {
+		desc, uri, header string
+		code              int
+		up                string
+	}{
+		{"scraped", up.URL, "10", http.StatusOK, "kibana_up 1"},
+		{"canceled at the scrape timeout minus the offset", hung.URL, "0.7", http.StatusOK, "kibana_up 0"},
+		{"invalid header", up.URL, "ten", http.StatusBadRequest, ""},
+	} {
+		restore := useConfigFile(t, dir, targetConfig(t, ht.uri, ""))
+		kib_exporter, err := buildExporter(log.NewNopLogger())
+		restore()
+		if err != nil {
+			t.Fatalf("%s: buildExporter failed with valid input: %s", ht.desc, err)
+		}
+
+		r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", ht.header)
+		w := httptest.NewRecorder()
+		start := time.Now()
+		handler(w, r, kib_exporter)
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("%s: expected the scrape to be canceled, took %s", ht.desc, elapsed)
+		}
+		if w.Code != ht.code {
+			t.Errorf("%s: expected status %d, got %d", ht.desc, ht.code, w.Code)
+		}
+		if ht.up != "" && !strings.Contains(w.Body.String(), ht.up+"\n") {
+			t.Errorf("%s: expected %s, got:\n%s", ht.desc, ht.up, w.Body.String())
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kibana-exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	holder := &exporterHolder{logger: log.NewNopLogger()}
+	for _, rt := range []struct {
+		desc, content, target string
+		valid                 bool
+	}{
+		{
+			desc:    "valid config",
+			content: "kibanas:\n  - name: kibana-1\n",
+			target:  "kibana-1",
+			valid:   true,
+		},
+		{
+			desc:    "invalid config keeps the current one",
+			content: "kibanas:\n  - name: kibana-2\n    port: http\n",
+			target:  "kibana-1",
+			valid:   false,
+		},
+		{
+			desc:    "valid config again",
+			content: "kibanas:\n  - name: kibana-2\n",
+			target:  "kibana-2",
+			valid:   true,
+		},
+	} {
+		restore := useConfigFile(t, dir, rt.content)
+		before := testutil.ToFloat64(configReloadSeconds)
+		err := holder.reload()
+		restore()
+		if rt.valid && err != nil {
+			t.Fatalf("%s: reload failed with valid input: %s", rt.desc, err)
+		}
+		if !rt.valid && err == nil {
+			t.Fatalf("%s: expected an error", rt.desc)
+		}
+		if holder.get().FindTarget(rt.target) == nil {
+			t.Errorf("%s: expected target %s", rt.desc, rt.target)
+		}
+
+		success := testutil.ToFloat64(configReloadSuccess)
+		reloaded := testutil.ToFloat64(configReloadSeconds)
+		if rt.valid && (success != 1 || reloaded == 0) {
+			t.Errorf("%s: expected a successful reload, got %v at %v", rt.desc, success, reloaded)
+		}
+		if !rt.valid && (success != 0 || reloaded != before) {
+			t.Errorf("%s: expected a failed reload, got %v at %v", rt.desc, success, reloaded)
+		}
+	}
+}
+
+func TestReloadHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kibana-exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	holder := &exporterHolder{logger: log.NewNopLogger()}
+	for _, rt := range []struct {
+		desc, method, content string
+		enabled               bool
+		code                  int
+	}{
+		{"disabled", http.MethodPost, "kibanas:\n  - name: kibana-1\n", false, http.StatusForbidden},
+		{"not a POST", http.MethodGet, "kibanas:\n  - name: kibana-1\n", true, http.StatusMethodNotAllowed},
+		{"valid config", http.MethodPost, "kibanas:\n  - name: kibana-1\n", true, http.StatusOK},
+		{"invalid config", http.MethodPost, "kibanas:\n  - name: kibana-1\n    port: http\n", true, http.StatusInternalServerError},
+	} {
+		restore := useConfigFile(t, dir, rt.content)
+		w := httptest.NewRecorder()
+		reloadHandler(holder, rt.enabled)(w, httptest.NewRequest(rt.method, "/-/reload", nil))
+		restore()
+		if w.Code != rt.code {
+			t.Errorf("%s: expected status %d, got %d", rt.desc, rt.code, w.Code)
+		}
+	}
+}
+
+func TestCheckConfigExitCodes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kibana-exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, ct := range []struct {
+		desc, content string
+		code          int
+	}{
+		{"valid config", "kibanas:\n  - name: kibana-1\n", exitOK},
+		{"invalid config", "kibanas:\n  - name: kibana-1\n    port: http\n", exitFailure},
+		{"label of a metric", "kibanas:\n  - name: kibana-1\n    labels: {level: prod}\n", exitFailure},
+	} {
+		restore := useConfigFile(t, dir, ct.content)
+		code := checkConfig()
+		restore()
+		if code != ct.code {
+			t.Errorf("%s: expected exit code %d, got %d", ct.desc, ct.code, code)
+		}
+	}
+}
+
+// targetConfig returns a config file with the target kibana-1 located at uri.
+func targetConfig(t *testing.T, uri string, extra string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("kibanas:\n  - name: kibana-1\n    host: %s\n    port: \"%s\"\n    timeout: 5s\n%s", u.Hostname(), u.Port(), extra)
+}
+
+func TestProbeExitCodes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kibana-exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"status":{"overall":{"level":"available"}}}`)
+	}))
+	defer up.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	for _, pt := range []struct {
+		desc, content string
+		targets       []string
+		code          int
+	}{
+		{"reachable target", targetConfig(t, up.URL, ""), nil, exitOK},
+		{"unreachable target", targetConfig(t, down.URL, ""), nil, exitFailure},
+		{"unknown target", targetConfig(t, up.URL, ""), []string{"kibana-2"}, exitConfigError},
+		{"label of a metric", targetConfig(t, up.URL, "    labels: {level: prod}\n"), nil, exitConfigError},
+	} {
+		restore := useConfigFile(t, dir, pt.content)
+		previous := *probeTargets
+		*probeTargets = pt.targets
+		code := probe(log.NewNopLogger())
+		*probeTargets = previous
+		restore()
+		if code != pt.code {
+			t.Errorf("%s: expected exit code %d, got %d", pt.desc, pt.code, code)
+		}
+	}
+}
+
+// constCollector sends the same metrics on each scrape.
+type constCollector []prometheus.Metric
+
+func (c constCollector) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(c, ch)
+}
+
+func (c constCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, m := range c {
+		ch <- m
+	}
+}
+
+// json output tests
+var writeMetricsTests = []struct {
+	desc     string
+	metric   prometheus.Metric
+	expected []jsonSample
+}{
+	{
+		desc: "gauge",
+		metric: prometheus.MustNewConstMetric(prometheus.NewDesc("kibana_up", "Kibana up", []string{"env"}, nil),
+			prometheus.GaugeValue, 1, "prod"),
+		expected: []jsonSample{
+			{Name: "kibana_up", Type: "gauge", Help: "Kibana up", Labels: map[string]string{"env": "prod"}, Value: 1},
+		},
+	},
+	{
+		desc: "counter",
+		metric: prometheus.MustNewConstMetric(prometheus.NewDesc("kibana_scrape_errors_total", "Kibana scrape errors", []string{"reason"}, nil),
+			prometheus.CounterValue, 3, "connect"),
+		expected: []jsonSample{
+			{Name: "kibana_scrape_errors_total", Type: "counter", Help: "Kibana scrape errors", Labels: map[string]string{"reason": "connect"}, Value: 3},
+		},
+	},
+	{
+		desc: "summary",
+		metric: prometheus.MustNewConstSummary(prometheus.NewDesc("kibana_latency_seconds", "Kibana latency", nil, nil),
+			4, 1.5, map[float64]float64{0.5: 0.25, 0.99: 0.75}),
+		expected: []jsonSample{
+			{Name: "kibana_latency_seconds", Type: "summary", Help: "Kibana latency", Labels: map[string]string{"quantile": "0.5"}, Value: 0.25},
+			{Name: "kibana_latency_seconds", Type: "summary", Help: "Kibana latency", Labels: map[string]string{"quantile": "0.99"}, Value: 0.75},
+			{Name: "kibana_latency_seconds_sum", Type: "summary", Help: "Kibana latency", Labels: map[string]string{}, Value: 1.5},
+			{Name: "kibana_latency_seconds_count", Type: "summary", Help: "Kibana latency", Labels: map[string]string{}, Value: 4},
+		},
+	},
+}
+
+func TestWriteMetricsJSON(t *testing.T) {
+	for _, wt := range writeMetricsTests {
+		t.Run(wt.desc, func(t *testing.T) {
+			registry := prometheus.NewRegistry()
+			registry.MustRegister(constCollector{wt.metric})
+			mfs, err := registry.Gather()
+			if err != nil {
+				t.Fatalf("Gather failed: %s", err)
+			}
+			var out bytes.Buffer
+			if err := writeMetrics(&out, mfs, "json"); err != nil {
+				t.Fatalf("writeMetrics failed: %s", err)
+			}
+			var samples []jsonSample
+			if err := json.Unmarshal(out.Bytes(), &samples); err != nil {
+				t.Fatalf("invalid json %s: %s", out.String(), err)
+			}
+			if !reflect.DeepEqual(samples, wt.expected) {
+				t.Errorf("expected samples:\n%+v\ngot:\n%+v", wt.expected, samples)
+			}
+		})
+	}
+}
+
+func TestWriteMetricsFormats(t *testing.T) {
+	metrics := constCollector{}
+	for _, wt := range writeMetricsTests {
+		metrics = append(metrics, wt.metric)
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metrics)
+	mfs, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Gather failed: %s", err)
+	}
+
+	for _, ft := range []struct {
+		format string
+		eof    bool
+	}{
+		{"text", false},
+		{"openmetrics", true},
+	} {
+		var out bytes.Buffer
+		if err := writeMetrics(&out, mfs, ft.format); err != nil {
+			t.Fatalf("%s: writeMetrics failed: %s", ft.format, err)
+		}
+		if !strings.Contains(out.String(), "kibana_up{env=\"prod\"} 1") {
+			t.Errorf("%s: expected the gauge, got:\n%s", ft.format, out.String())
+		}
+		if strings.HasSuffix(out.String(), "# EOF\n") != ft.eof {
+			t.Errorf("%s: expected # EOF trailer %v, got:\n%s", ft.format, ft.eof, out.String())
+		}
+	}
+}
+
+func TestScrapeFailed(t *testing.T) {
+	up := prometheus.NewDesc("kibana_up", "Kibana up", nil, nil)
+	for _, st := range []struct {
+		desc    string
+		metrics constCollector
+		failed  bool
+	}{
+		{"up", constCollector{prometheus.MustNewConstMetric(up, prometheus.GaugeValue, 1)}, false},
+		{"down", constCollector{prometheus.MustNewConstMetric(up, prometheus.GaugeValue, 0)}, true},
+		{"not scraped", constCollector{writeMetricsTests[1].metric}, true},
+	} {
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(st.metrics)
+		mfs, err := registry.Gather()
+		if err != nil {
+			t.Fatalf("%s: Gather failed: %s", st.desc, err)
+		}
+		if scrapeFailed(mfs) != st.failed {
+			t.Errorf("%s: expected failed %v", st.desc, st.failed)
+		}
+	}
+}